@@ -0,0 +1,168 @@
+package goriffle
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AuthFunc answers the node's challenge for one authentication method. It is
+// handed the hello details and the challenge's extra dict, and returns the
+// signature and extra dict of the aUTHENTICATE message.
+type AuthFunc func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error)
+
+// Config is what a session needs to connect and authenticate to the node
+type Config struct {
+	// The serializations to offer the node, most preferred first, such as
+	// SubprotocolJSON. Defaults to JSON, then msgpack.
+	Subprotocols []string
+
+	// Who to authenticate as
+	AuthID string
+
+	// How to answer the node's challenge, by authentication method, for
+	// example {"wampcra": CRA(secret)} or {"ticket": Ticket(ticket)}
+	Auth map[string]AuthFunc
+
+	// Sent to the node along with the authid, such as a cryptosign public key
+	AuthExtra map[string]interface{}
+}
+
+// UseCryptosign has the session authenticate with WAMP-cryptosign, announcing
+// the key's public half to the node
+func (cfg *Config) UseCryptosign(key ed25519.PrivateKey) {
+	if cfg.Auth == nil {
+		cfg.Auth = make(map[string]AuthFunc)
+	}
+	if cfg.AuthExtra == nil {
+		cfg.AuthExtra = make(map[string]interface{})
+	}
+
+	cfg.Auth["cryptosign"] = Cryptosign(key)
+	cfg.AuthExtra["pubkey"] = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// The hello details to join with
+func (cfg *Config) details() map[string]interface{} {
+	details := make(map[string]interface{})
+	if cfg == nil {
+		return details
+	}
+
+	if cfg.AuthID != "" {
+		details["authid"] = cfg.AuthID
+	}
+	if len(cfg.AuthExtra) > 0 {
+		details["authextra"] = cfg.AuthExtra
+	}
+	return details
+}
+
+// The defaults crossbar salts WAMP-CRA secrets with
+const (
+	defaultCRAIterations = 1000
+	defaultCRAKeyLength  = 32
+)
+
+// CRA answers WAMP-CRA challenges with the given secret. When the challenge
+// comes with a salt the secret is first derived into a key with PBKDF2.
+func CRA(secret string) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		ch, ok := challenge["challenge"].(string)
+		if !ok {
+			return "", nil, fmt.Errorf("no challenge in WAMP-CRA challenge")
+		}
+
+		key := secret
+		if salt := detailString(challenge, "salt"); salt != "" {
+			iterations, keyLength := int(detailID(challenge, "iterations")), int(detailID(challenge, "keylen"))
+			if iterations == 0 {
+				iterations = defaultCRAIterations
+			}
+			if keyLength == 0 {
+				keyLength = defaultCRAKeyLength
+			}
+			key = deriveCRAKey(secret, salt, iterations, keyLength)
+		}
+
+		return signCRAChallenge(key, ch), map[string]interface{}{}, nil
+	}
+}
+
+// Ticket answers ticket challenges with the given ticket
+func Ticket(ticket string) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		return ticket, map[string]interface{}{}, nil
+	}
+}
+
+// Cryptosign answers WAMP-cryptosign challenges by signing them with the key.
+// The node has to know the public half, see Config.UseCryptosign.
+func Cryptosign(key ed25519.PrivateKey) AuthFunc {
+	return func(hello map[string]interface{}, challenge map[string]interface{}) (string, map[string]interface{}, error) {
+		ch, err := hex.DecodeString(detailString(challenge, "challenge"))
+		if err != nil || len(ch) == 0 {
+			return "", nil, fmt.Errorf("no challenge in cryptosign challenge")
+		}
+
+		// The node expects the signed message, which is the signature followed
+		// by the challenge
+		signed := append(ed25519.Sign(key, ch), ch...)
+		return hex.EncodeToString(signed), map[string]interface{}{}, nil
+	}
+}
+
+// NewCryptosignKey makes an Ed25519 key out of a 32 byte seed
+func NewCryptosignKey(seed []byte) (ed25519.PrivateKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("cryptosign seed is %d bytes, expected %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// LoadCryptosignKey reads an Ed25519 key from a file. The file can hold the
+// raw 32 byte seed, the seed in hex, or be a crossbar key file with a
+// "private-key-ed25519" line.
+func LoadCryptosignKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == ed25519.SeedSize {
+		return NewCryptosignKey(data)
+	}
+
+	text := strings.TrimSpace(string(data))
+	for _, line := range strings.Split(text, "\n") {
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 && strings.TrimSpace(parts[0]) == "private-key-ed25519" {
+			text = strings.TrimSpace(parts[1])
+			break
+		}
+	}
+
+	seed, err := hex.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cryptosign key from %s: %v", path, err)
+	}
+	return NewCryptosignKey(seed)
+}
+
+// Salt a secret the same way crossbar and autobahn do
+func deriveCRAKey(secret, salt string, iterations, keyLength int) string {
+	key := pbkdf2.Key([]byte(secret), []byte(salt), iterations, keyLength, sha256.New)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func signCRAChallenge(key, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(challenge))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,133 @@
+package goriffle
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCRA(t *testing.T) {
+	challenge := `{"nonce": "abc"}`
+
+	Convey("WAMP-CRA", t, func() {
+		Convey("Signs the challenge with the secret", func() {
+			sig, _, err := CRA("secret")(nil, map[string]interface{}{"challenge": challenge})
+			So(err, ShouldBeNil)
+			So(sig, ShouldEqual, "9lMN20jckcB+W6OTBx3tIqeDQM2tW3dtVWIey0tWHEY=")
+		})
+
+		Convey("Salts the secret when asked to", func() {
+			So(deriveCRAKey("secret", "salt", 1000, 32), ShouldEqual, "qN+JnzxPIE2WfgrWPAkph8EAVeuwF7PZ0ordIY1Peq0=")
+
+			extra := map[string]interface{}{"challenge": challenge, "salt": "salt", "iterations": float64(1000), "keylen": uint64(32)}
+			sig, _, err := CRA("secret")(nil, extra)
+			So(err, ShouldBeNil)
+			So(sig, ShouldEqual, "LItWnyoiQYxSga/DijLCSY9bOn6fRE1beEXpfL7SRZY=")
+		})
+
+		Convey("Needs a challenge", func() {
+			_, _, err := CRA("secret")(nil, map[string]interface{}{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestJoinWithConfig(t *testing.T) {
+	Convey("Joining with a config", t, func() {
+		conn := newTestConnection()
+		s := newSession(conn)
+		cfg := &Config{AuthID: "bob", Auth: map[string]AuthFunc{"ticket": Ticket("hunter2")}}
+		s.Auth = cfg.Auth
+
+		joined := make(chan error, 1)
+		go func() {
+			_, err := s.JoinRealm("xs.test", cfg.details())
+			joined <- err
+		}()
+
+		h := (<-conn.out).(*hello)
+		So(h.Details["authid"], ShouldEqual, "bob")
+		So(h.Details["authmethods"], ShouldResemble, []interface{}{"ticket"})
+
+		conn.in <- &challenge{AuthMethod: "ticket", Extra: map[string]interface{}{}}
+		So((<-conn.out).(*authenticate).Signature, ShouldEqual, "hunter2")
+
+		conn.in <- &welcome{Id: 1, Details: map[string]interface{}{}}
+		So(<-joined, ShouldBeNil)
+	})
+}
+
+func TestCryptosign(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key, _ := NewCryptosignKey(seed)
+	pub := key.Public().(ed25519.PublicKey)
+
+	Convey("Cryptosign", t, func() {
+		Convey("Signs the challenge with the key", func() {
+			challenge := bytes.Repeat([]byte{1}, 32)
+			sig, _, err := Cryptosign(key)(nil, map[string]interface{}{"challenge": hex.EncodeToString(challenge)})
+			So(err, ShouldBeNil)
+
+			signed, err := hex.DecodeString(sig)
+			So(err, ShouldBeNil)
+			So(signed[ed25519.SignatureSize:], ShouldResemble, challenge)
+			So(ed25519.Verify(pub, challenge, signed[:ed25519.SignatureSize]), ShouldBeTrue)
+		})
+
+		Convey("Needs a challenge", func() {
+			_, _, err := Cryptosign(key)(nil, map[string]interface{}{"challenge": "not hex"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Announces the public key", func() {
+			cfg := &Config{AuthID: "device"}
+			cfg.UseCryptosign(key)
+
+			details := cfg.details()
+			So(details["authextra"], ShouldResemble, map[string]interface{}{"pubkey": hex.EncodeToString(pub)})
+			So(cfg.Auth["cryptosign"], ShouldNotBeNil)
+		})
+
+		Convey("Loads keys from", func() {
+			dir, err := ioutil.TempDir("", "cryptosign")
+			So(err, ShouldBeNil)
+			Reset(func() { os.RemoveAll(dir) })
+
+			load := func(contents []byte) (ed25519.PrivateKey, error) {
+				path := filepath.Join(dir, "key")
+				So(ioutil.WriteFile(path, contents, 0600), ShouldBeNil)
+				return LoadCryptosignKey(path)
+			}
+
+			Convey("Raw seeds", func() {
+				loaded, err := load(seed)
+				So(err, ShouldBeNil)
+				So(loaded, ShouldResemble, key)
+			})
+
+			Convey("Hex seeds", func() {
+				loaded, err := load([]byte(hex.EncodeToString(seed) + "\n"))
+				So(err, ShouldBeNil)
+				So(loaded, ShouldResemble, key)
+			})
+
+			Convey("Crossbar key files", func() {
+				file := "creator: bob\npublic-key-ed25519: " + hex.EncodeToString(pub) + "\nprivate-key-ed25519: " + hex.EncodeToString(seed) + "\n"
+				loaded, err := load([]byte(file))
+				So(err, ShouldBeNil)
+				So(loaded, ShouldResemble, key)
+			})
+
+			Convey("But not garbage", func() {
+				_, err := load([]byte("garbage"))
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
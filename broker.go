@@ -0,0 +1,218 @@
+package goriffle
+
+import (
+	"sync"
+)
+
+// The broker fans publications out to the subscribers of their topic
+type broker struct {
+	// exact topic -> subscription id -> subscription
+	topics map[string]map[uint]*subscription
+	// prefix and wildcard subscriptions, which have to be checked one by one
+	patterns      map[uint]*subscription
+	subscriptions map[uint]*subscription
+	lock          sync.Mutex
+}
+
+// An agent's interest in a topic, or in every topic matching a pattern
+type subscription struct {
+	topic      string
+	match      string
+	subscriber *agent
+}
+
+func newBroker() *broker {
+	return &broker{
+		topics:        make(map[string]map[uint]*subscription),
+		patterns:      make(map[uint]*subscription),
+		subscriptions: make(map[uint]*subscription),
+	}
+}
+
+// Send an event to every subscriber of the topic the publication's options
+// allow, acknowledging the publication if the publisher asked for it
+func (b *broker) publish(publisher *agent, msg *publish) {
+	publication := newID()
+	filter := newPublishFilter(publisher, msg.Options)
+
+	details := make(map[string]interface{})
+	if disclose, _ := msg.Options["disclose_me"].(bool); disclose {
+		details["publisher"] = publisher.id
+		details["publisher_authid"] = publisher.domain
+		details["publisher_authrole"] = publisher.authrole
+	}
+
+	// Subscribers to a pattern are told which topic the event was published to
+	patternDetails := map[string]interface{}{"topic": msg.Domain}
+	for k, v := range details {
+		patternDetails[k] = v
+	}
+
+	b.lock.Lock()
+	var deliveries []func()
+	deliver := func(id uint, sub *subscription, details map[string]interface{}) {
+		if !filter.allows(sub.subscriber) {
+			return
+		}
+
+		evt := &event{
+			Subscription: id,
+			Publication:  publication,
+			Details:      details,
+			Arguments:    msg.Arguments,
+			ArgumentsKw:  msg.ArgumentsKw,
+		}
+
+		subscriber := sub.subscriber
+		deliveries = append(deliveries, func() { subscriber.deliver(evt) })
+	}
+
+	for id, sub := range b.topics[msg.Domain] {
+		deliver(id, sub, details)
+	}
+	for id, sub := range b.patterns {
+		if matchEndpoint(sub.topic, msg.Domain, sub.match) {
+			deliver(id, sub, patternDetails)
+		}
+	}
+	b.lock.Unlock()
+
+	for _, d := range deliveries {
+		d()
+	}
+
+	if ack, _ := msg.Options["acknowledge"].(bool); ack {
+		publisher.deliver(&published{Request: msg.Request, Publication: publication})
+	}
+}
+
+func (b *broker) subscribe(subscriber *agent, msg *subscribe) {
+	match, _ := msg.Options["match"].(string)
+	if match == "" {
+		match = "exact"
+	} else if !validMatch(match) {
+		subscriber.deliver(nodeError(sUBSCRIBE, msg.Request, ErrInvalidArgument))
+		return
+	}
+
+	id := newID()
+	sub := &subscription{topic: msg.Domain, match: match, subscriber: subscriber}
+
+	b.lock.Lock()
+	b.subscriptions[id] = sub
+	if match == "exact" {
+		if b.topics[msg.Domain] == nil {
+			b.topics[msg.Domain] = make(map[uint]*subscription)
+		}
+		b.topics[msg.Domain][id] = sub
+	} else {
+		b.patterns[id] = sub
+	}
+	b.lock.Unlock()
+
+	subscriber.deliver(&subscribed{Request: msg.Request, Subscription: id})
+}
+
+func (b *broker) unsubscribe(subscriber *agent, msg *unsubscribe) {
+	b.lock.Lock()
+	sub, ok := b.subscriptions[msg.Subscription]
+	if ok && sub.subscriber == subscriber {
+		b.drop(msg.Subscription)
+	} else {
+		ok = false
+	}
+	b.lock.Unlock()
+
+	if !ok {
+		subscriber.deliver(nodeError(uNSUBSCRIBE, msg.Request, ErrNoSuchSubscription))
+		return
+	}
+
+	subscriber.deliver(&unsubscribed{Request: msg.Request})
+}
+
+// Drop all subscriptions held by the agent
+func (b *broker) remove(subscriber *agent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for id, sub := range b.subscriptions {
+		if sub.subscriber == subscriber {
+			b.drop(id)
+		}
+	}
+}
+
+// Forget a subscription. Caller must hold the lock.
+func (b *broker) drop(id uint) {
+	sub := b.subscriptions[id]
+	delete(b.subscriptions, id)
+	delete(b.patterns, id)
+	delete(b.topics[sub.topic], id)
+
+	if len(b.topics[sub.topic]) == 0 {
+		delete(b.topics, sub.topic)
+	}
+}
+
+// Decides which subscribers get a publication
+type publishFilter struct {
+	publisher *agent
+	excludeMe bool
+
+	eligible         []uint
+	eligibleAuthID   []string
+	eligibleAuthRole []string
+	exclude          []uint
+	excludeAuthID    []string
+	excludeAuthRole  []string
+}
+
+func newPublishFilter(publisher *agent, options map[string]interface{}) *publishFilter {
+	f := &publishFilter{publisher: publisher, excludeMe: true}
+	if excludeMe, ok := options["exclude_me"].(bool); ok {
+		f.excludeMe = excludeMe
+	}
+
+	detailList(options, "eligible", &f.eligible)
+	detailList(options, "eligible_authid", &f.eligibleAuthID)
+	detailList(options, "eligible_authrole", &f.eligibleAuthRole)
+	detailList(options, "exclude", &f.exclude)
+	detailList(options, "exclude_authid", &f.excludeAuthID)
+	detailList(options, "exclude_authrole", &f.excludeAuthRole)
+	return f
+}
+
+func (f *publishFilter) allows(a *agent) bool {
+	if f.excludeMe && a == f.publisher {
+		return false
+	}
+
+	if len(f.eligible) > 0 && !containsID(f.eligible, a.id) ||
+		len(f.eligibleAuthID) > 0 && !containsString(f.eligibleAuthID, a.domain) ||
+		len(f.eligibleAuthRole) > 0 && !containsString(f.eligibleAuthRole, a.authrole) {
+		return false
+	}
+
+	return !containsID(f.exclude, a.id) &&
+		!containsString(f.excludeAuthID, a.domain) &&
+		!containsString(f.excludeAuthRole, a.authrole)
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(strs []string, s string) bool {
+	for _, i := range strs {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
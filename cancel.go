@@ -0,0 +1,95 @@
+package goriffle
+
+import (
+	"context"
+	"log"
+)
+
+// CancelMode decides what happens to a call whose context is done before the
+// result comes back.
+type CancelMode string
+
+const (
+	// The callee is left to finish, and its result thrown away. The default.
+	CancelSkip CancelMode = "skip"
+	// The callee is interrupted, and the caller waits for it to stop.
+	CancelKill CancelMode = "kill"
+	// The callee is interrupted, but the caller doesn't wait for it to stop.
+	CancelKillNoWait CancelMode = "killnowait"
+)
+
+type cancelModeKey struct{}
+
+// WithCancelMode returns a context that cancels calls made with it in the given mode
+func WithCancelMode(ctx context.Context, mode CancelMode) context.Context {
+	return context.WithValue(ctx, cancelModeKey{}, mode)
+}
+
+func cancelModeFrom(ctx context.Context) CancelMode {
+	if mode, ok := ctx.Value(cancelModeKey{}).(CancelMode); ok {
+		return mode
+	}
+	return CancelSkip
+}
+
+// Tell the node we are no longer interested in the result of the given call.
+// When killing the call, wait for the node to confirm the callee stopped.
+func (c *session) cancelCall(ctx context.Context, id uint) {
+	mode := cancelModeFrom(ctx)
+
+	if err := c.Send(&cancel{Request: id, Options: map[string]interface{}{"mode": string(mode)}}); err != nil {
+		log.Println("error sending message:", err)
+		return
+	}
+
+	if mode == CancelKill {
+		wait, done := c.timeoutContext()
+		defer done()
+
+		// Progressive results may still be on their way, but only the error or
+		// the final result says the callee has stopped
+		for {
+			msg, err := c.nextMessage(wait, id)
+			if err != nil {
+				log.Println("callee did not confirm cancel:", err)
+				return
+			} else if r, ok := msg.(*result); !ok || !isProgress(r.Details) {
+				return
+			}
+		}
+	}
+}
+
+// Start tracking an invocation, returning the context its handler runs in
+func (c *session) startInvocation(request uint) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.lock.Lock()
+	c.invocations[request] = cancel
+	c.lock.Unlock()
+	return ctx
+}
+
+func (c *session) finishInvocation(request uint) {
+	c.lock.Lock()
+	cancel, ok := c.invocations[request]
+	delete(c.invocations, request)
+	c.lock.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// The caller gave up on an invocation, so cancel the context its handler runs in
+func (c *session) handleInterrupt(msg *interrupt) {
+	c.lock.Lock()
+	cancel, ok := c.invocations[msg.Request]
+	c.lock.Unlock()
+
+	if ok {
+		cancel()
+	} else {
+		log.Println("no invocation to interrupt:", msg.Request)
+	}
+}
@@ -1,10 +1,11 @@
 package goriffle
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
-	"time"
 
 	"github.com/exis-io/browrilla"
 )
@@ -34,8 +35,8 @@ type connection interface {
 	Receive() <-chan message
 }
 
-// Convenience function to get a single message from a peer
-func getMessageTimeout(p connection, t time.Duration) (message, error) {
+// Convenience function to get a single message from a peer, giving up once ctx is done
+func getMessageContext(ctx context.Context, p connection) (message, error) {
 	select {
 	case msg, open := <-p.Receive():
 		if !open {
@@ -43,11 +44,23 @@ func getMessageTimeout(p connection, t time.Duration) (message, error) {
 		}
 
 		return msg, nil
-	case <-time.After(t):
-		return nil, fmt.Errorf("timeout waiting for message")
+	case <-ctx.Done():
+		return nil, contextError(ctx)
 	}
 }
 
+// Describe why ctx ended, keeping the old timeout wording for deadlines
+// ErrConnectionClosed is returned to callers still waiting on a reply when the
+// connection it would have come in on goes away.
+var ErrConnectionClosed = errors.New("connection closed")
+
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timeout waiting for message: %w", ctx.Err())
+	}
+	return ctx.Err()
+}
+
 // TODO: make this just add the message to a channel so we don't block
 func (ep *websocketConnection) Send(msg message) error {
 
@@ -62,8 +75,7 @@ func (ep *websocketConnection) Send(msg message) error {
 	}
 
 	ep.connLock.Lock()
-	// err = ep.conn.WriteMessage(ep.payloadType, b)
-	_, err = ep.conn.UnderlyingConn().Write(b)
+	err = ep.conn.WriteMessage(ep.payloadType, b)
 	// err = ep.jsws.Send(b)
 	ep.connLock.Unlock()
 
@@ -121,30 +133,134 @@ func (ep *websocketConnection) run() {
 	}
 }
 
+// A caller waiting on replies to one of its requests. Replies queue up
+// without bound, so the receive loop never waits on a caller that is slow to
+// take them, such as one handling a stream of progressive results.
+type listener struct {
+	lock  sync.Mutex
+	queue []message
+	// set once no more replies can arrive
+	closed bool
+	// signalled when the queue goes from empty to not, or on closing
+	ready chan struct{}
+}
+
+func (l *listener) push(msg message) {
+	l.lock.Lock()
+	l.queue = append(l.queue, msg)
+	l.lock.Unlock()
+	l.signal()
+}
+
+// Give up on any further replies. Those already queued are still handed out.
+func (l *listener) close() {
+	l.lock.Lock()
+	l.closed = true
+	l.lock.Unlock()
+	l.signal()
+}
+
+func (l *listener) signal() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+// The next queued reply, or ErrConnectionClosed if there is none and never
+// will be
+func (l *listener) pop() (message, bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.queue) == 0 {
+		if l.closed {
+			return nil, false, ErrConnectionClosed
+		}
+		return nil, false, nil
+	}
+
+	msg := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	return msg, true, nil
+}
+
+// Listen for replies to the given request
 func (c *session) registerListener(id uint) {
 	//log.Println("register listener:", id)
-	wait := make(chan message, 1)
-	c.listeners[id] = wait
+	l := &listener{ready: make(chan struct{}, 1)}
+
+	c.lock.Lock()
+	c.listeners[id] = l
+	c.lock.Unlock()
 }
 
-func (c *session) waitOnListener(id uint) (message, error) {
-	if wait, ok := c.listeners[id]; !ok {
+// Fail every request still waiting on a reply, since the connection their
+// replies would have come in on is gone
+func (c *session) closeListeners() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, l := range c.listeners {
+		l.close()
+	}
+}
+
+func (c *session) removeListener(id uint) {
+	c.lock.Lock()
+	delete(c.listeners, id)
+	c.lock.Unlock()
+}
+
+// Wait for the reply to the given request. The listener is removed once this
+// returns, whether a reply arrived or not.
+func (c *session) waitOnListener(ctx context.Context, id uint) (message, error) {
+	defer c.removeListener(id)
+	return c.nextMessage(ctx, id)
+}
+
+// Wait for the next reply to the given request, leaving the listener in place
+func (c *session) nextMessage(ctx context.Context, id uint) (message, error) {
+	c.lock.Lock()
+	l, ok := c.listeners[id]
+	c.lock.Unlock()
+
+	if !ok {
 		return nil, fmt.Errorf("unknown listener uint: %v", id)
-	} else {
-		select {
-		case msg := <-wait:
+	}
+
+	for {
+		if msg, ok, err := l.pop(); ok {
 			return msg, nil
-		case <-time.After(c.ReceiveTimeout):
-			return nil, fmt.Errorf("timeout while waiting for message")
+		} else if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-l.ready:
+		case <-ctx.Done():
+			return nil, contextError(ctx)
 		}
 	}
 }
 
+// A context that expires after the session's ReceiveTimeout, used by the
+// blocking calls that don't take a context of their own
+func (c *session) timeoutContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.ReceiveTimeout)
+}
+
 func (c *session) notifyListener(msg message, requestId uint) {
 	// pass in the request uint so we don't have to do any type assertion
-	if l, ok := c.listeners[requestId]; ok {
-		l <- msg
-	} else {
+	c.lock.Lock()
+	l, ok := c.listeners[requestId]
+	c.lock.Unlock()
+
+	if !ok {
 		log.Println("no listener for message", msg.messageType(), requestId)
+		return
 	}
+
+	l.push(msg)
 }
@@ -0,0 +1,69 @@
+package goriffle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/exis-io/browrilla"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// A websocket server speaking only the given subprotocol, which echoes every
+// message back, reporting what kind of frame it came in
+func echoWebsocket(protocol string, frames chan int) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{protocol}}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			typ, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			frames <- typ
+			conn.WriteMessage(typ, b)
+		}
+	}))
+}
+
+func TestWebsocketSubprotocols(t *testing.T) {
+	Convey("Websocket connections", t, func() {
+		Convey("Speak the subprotocol the node picked", func() {
+			for protocol, frame := range map[string]int{
+				SubprotocolJSON:    websocket.TextMessage,
+				SubprotocolMsgpack: websocket.BinaryMessage,
+			} {
+				frames := make(chan int, 1)
+				server := echoWebsocket(protocol, frames)
+
+				conn, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), defaultSubprotocols)
+				So(err, ShouldBeNil)
+
+				So(conn.Send(&published{Request: 1, Publication: 2}), ShouldBeNil)
+				So(<-frames, ShouldEqual, frame)
+
+				msg, ok := (<-conn.Receive()).(*published)
+				So(ok, ShouldBeTrue)
+				So(msg.Publication, ShouldEqual, 2)
+
+				server.Close()
+			}
+		})
+
+		Convey("Refuse nodes that pick a subprotocol they don't speak", func() {
+			server := echoWebsocket("wamp.2.ubjson", make(chan int, 1))
+			defer server.Close()
+
+			_, err := dialWebsocket("ws"+strings.TrimPrefix(server.URL, "http"), []string{"wamp.2.ubjson"})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
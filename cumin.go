@@ -1,47 +1,153 @@
 package goriffle
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"reflect"
+	"runtime/debug"
 )
 
-// Convert and apply args to arbitrary function fn
-func cumin(fn interface{}, args []interface{}) ([]interface{}, error) {
+// Kwargs are the keyword arguments of a call, publication, or result.
+//
+// A Kwargs passed as the last argument to Call or Publish is sent as keyword
+// arguments. A handler whose last parameter is a Kwargs receives the keyword
+// arguments there, and one that returns a Kwargs has it sent back as the
+// keyword arguments of its result.
+type Kwargs map[string]interface{}
+
+// Progress sends a progressive result to the caller of a procedure. A handler
+// that declares a Progress parameter is handed one for the call it is serving
+// and can use it to stream partial results before it returns the final one.
+// The arguments are handled like those passed to Call.
+type Progress func(args ...interface{}) error
+
+var (
+	kwargsType  = reflect.TypeOf(Kwargs{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// Convert and apply args to arbitrary function fn.
+//
+// Parameters of the same type as one of the injected values are handed that
+// value and don't count towards the positional args. Procedure handlers are
+// injected with a Progress, and a context.Context that is cancelled if the
+// caller gives up on the call and the node interrupts it.
+//
+// If fn's last return value is an error it is not part of the results: a
+// non-nil error is returned as cumin's error instead. Args that can't be
+// applied to fn are reported as an *Error with ErrInvalidArgument, and a
+// panic in fn as an *Error with ErrRuntimeError.
+func cumin(fn interface{}, args []interface{}, kwargs map[string]interface{}, injected ...interface{}) (ret []interface{}, err error) {
+	// A broken handler fails its own call, not the whole process
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("handler panicked: %v\n%s", r, debug.Stack())
+			ret, err = nil, NewError(ErrRuntimeError, fmt.Sprint(r))
+		}
+	}()
+
 	reciever := reflect.TypeOf(fn)
-	var ret []interface{}
 
 	// Check to make sure the pointer is actually a function
-	if reciever.Kind() != reflect.Func {
+	if reciever == nil || reciever.Kind() != reflect.Func {
 		return ret, fmt.Errorf("Handler is not a function!")
 	}
 
-	if reciever.NumIn() != len(args) {
-		return ret, fmt.Errorf("Cumin ERR: expected %s args for function %s, got %s", reciever.NumIn(), reciever, len(args))
+	// A trailing Kwargs parameter takes the keyword arguments
+	numIn := reciever.NumIn()
+	takesKwargs := numIn > 0 && reciever.In(numIn-1) == kwargsType
+	if takesKwargs {
+		numIn--
+	}
+
+	// Injected parameters are filled in here, positional ones left invalid
+	values := make([]reflect.Value, numIn, reciever.NumIn())
+	numArgs := numIn
+	for i := 0; i < numIn; i++ {
+		if v, ok := injection(reciever.In(i), injected); ok {
+			values[i] = v
+			numArgs--
+		}
+	}
+
+	if numArgs != len(args) {
+		return ret, NewError(ErrInvalidArgument, fmt.Sprintf("Cumin ERR: expected %d args for function %s, got %d", numArgs, reciever, len(args)))
 	}
 
 	// Iterate over the params listed in the method and try their casts
-	values := make([]reflect.Value, len(args))
-	for i := 0; i < reciever.NumIn(); i++ {
-		param := reciever.In(i)
-		arg := reflect.ValueOf(args[i])
-
-		if param == arg.Type() {
-			values[i] = arg
-		} else if arg.Type().ConvertibleTo(param) {
-			values[i] = arg.Convert(param)
+	for i, arg := 0, 0; i < numIn; i++ {
+		if values[i].IsValid() {
+			continue
+		}
+
+		if v, err := convertArg(args[arg], reciever.In(i)); err != nil {
+			return ret, NewError(ErrInvalidArgument, fmt.Sprintf("Cumin ERR: %s for arg[%d] in (%s)", err, arg, reciever))
 		} else {
-			return ret, fmt.Errorf("Cumin ERR: expected %s for arg[%d] in (%s), got %s.", param, i, reciever, arg.Type())
+			values[i] = v
 		}
+		arg++
+	}
+
+	if takesKwargs {
+		if kwargs == nil {
+			kwargs = make(map[string]interface{})
+		}
+		values = append(values, reflect.ValueOf(Kwargs(kwargs)))
 	}
 
 	// Perform the call
 	result := reflect.ValueOf(fn).Call(values)
 
+	// Pull off the error the handler returned, if it returns one
+	if n := reciever.NumOut(); n > 0 && reciever.Out(n-1) == errorType {
+		if e := result[n-1].Interface(); e != nil {
+			return ret, e.(error)
+		}
+		result = result[:n-1]
+	}
+
 	for _, x := range result {
 		ret = append(ret, x.Interface())
 	}
 
-	// Catch any exceptions this produces and pass them to the function that sent them, or some kind of handler
-
 	return ret, nil
 }
+
+// Find the injected value for a parameter of the given type. Contexts are
+// injected into context.Context parameters whatever their concrete type.
+func injection(param reflect.Type, injected []interface{}) (reflect.Value, bool) {
+	for _, v := range injected {
+		if v == nil {
+			continue
+		}
+
+		if reflect.TypeOf(v) == param {
+			return reflect.ValueOf(v), true
+		} else if _, ok := v.(context.Context); ok && param == contextType {
+			return reflect.ValueOf(v).Convert(contextType), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Split a trailing Kwargs off a list of arguments
+func splitKwargs(args []interface{}) ([]interface{}, map[string]interface{}) {
+	if len(args) == 0 {
+		return args, nil
+	}
+
+	if kwargs, ok := args[len(args)-1].(Kwargs); ok {
+		return args[:len(args)-1], kwargs
+	}
+	return args, nil
+}
+
+// Put keyword arguments back on the end of a list of arguments, if there are any
+func joinKwargs(args []interface{}, kwargs map[string]interface{}) []interface{} {
+	if len(kwargs) == 0 {
+		return args
+	}
+	return append(args, Kwargs(kwargs))
+}
@@ -1,7 +1,9 @@
 package goriffle
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -9,12 +11,12 @@ import (
 func TestCuminXNone(t *testing.T) {
 	Convey("Functions that return nothing", t, func() {
 		Convey("Should accept no args", func() {
-			_, e := cumin(noneNone, []interface{}{})
+			_, e := cumin(noneNone, []interface{}{}, nil)
 			So(e, ShouldBeNil)
 		})
 
 		Convey("Should accept one arg", func() {
-			_, e := cumin(oneNone, []interface{}{1})
+			_, e := cumin(oneNone, []interface{}{1}, nil)
 
 			So(e, ShouldBeNil)
 			// So(r[0] ShouldEqual, 1)
@@ -22,6 +24,219 @@ func TestCuminXNone(t *testing.T) {
 	})
 }
 
+func TestCuminKwargs(t *testing.T) {
+	Convey("Functions that take Kwargs", t, func() {
+		Convey("Should receive the keyword arguments", func() {
+			r, e := cumin(oneKwargs, []interface{}{1}, map[string]interface{}{"b": 2})
+
+			So(e, ShouldBeNil)
+			So(r, ShouldResemble, []interface{}{2})
+		})
+
+		Convey("Should receive empty Kwargs when there are none", func() {
+			r, e := cumin(oneKwargs, []interface{}{1}, nil)
+
+			So(e, ShouldBeNil)
+			So(r, ShouldResemble, []interface{}{0})
+		})
+
+		Convey("Should still count positional args", func() {
+			_, e := cumin(oneKwargs, []interface{}{}, nil)
+			So(e, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Functions that take injected values", t, func() {
+		Convey("Should get them wherever they are in the parameters", func() {
+			var sent []interface{}
+			progress := Progress(func(args ...interface{}) error {
+				sent = append(sent, args...)
+				return nil
+			})
+
+			r, e := cumin(func(a int, p Progress, b int) int {
+				p(a)
+				return b
+			}, []interface{}{1, 2}, nil, progress)
+
+			So(e, ShouldBeNil)
+			So(r, ShouldResemble, []interface{}{2})
+			So(sent, ShouldResemble, []interface{}{1})
+		})
+	})
+
+	Convey("Trailing Kwargs", t, func() {
+		Convey("Should be split off argument lists", func() {
+			args, kwargs := splitKwargs([]interface{}{1, Kwargs{"a": 1}})
+
+			So(args, ShouldResemble, []interface{}{1})
+			So(kwargs, ShouldResemble, map[string]interface{}{"a": 1})
+		})
+
+		Convey("Should leave plain argument lists alone", func() {
+			args, kwargs := splitKwargs([]interface{}{1, map[string]interface{}{"a": 1}})
+
+			So(len(args), ShouldEqual, 2)
+			So(kwargs, ShouldBeNil)
+		})
+	})
+}
+
+func TestCuminDecoding(t *testing.T) {
+	// Arguments as the jSON serializer would hand them over
+	var args []interface{}
+	json.Unmarshal([]byte(`[
+		{"name": "bob", "Age": 42, "tags": ["a", "b"], "ignored": true, "friend": {"name": "alice"}},
+		["x", "y"],
+		{"a": 1, "b": 2},
+		{"1": "one"},
+		"2015-10-21T16:29:00Z",
+		[{"name": "carol"}]
+	]`), &args)
+
+	Convey("Handlers can take", t, func() {
+		Convey("Structs, honoring json tags", func() {
+			r, e := cumin(func(p person) person { return p }, args[:1], nil)
+
+			So(e, ShouldBeNil)
+			p := r[0].(person)
+			So(p.Name, ShouldEqual, "bob")
+			So(p.Age, ShouldEqual, 42)
+			So(p.Tags, ShouldResemble, []string{"a", "b"})
+			So(p.Friend.Name, ShouldEqual, "alice")
+			So(p.Friend.Friend, ShouldBeNil)
+		})
+
+		Convey("Typed slices", func() {
+			r, e := cumin(func(s []string) int { return len(s) }, args[1:2], nil)
+			So(e, ShouldBeNil)
+			So(r[0], ShouldEqual, 2)
+		})
+
+		Convey("Typed maps", func() {
+			r, e := cumin(func(m map[string]int) int { return m["a"] + m["b"] }, args[2:3], nil)
+			So(e, ShouldBeNil)
+			So(r[0], ShouldEqual, 3)
+		})
+
+		Convey("Maps with numeric keys", func() {
+			r, e := cumin(func(m map[int]string) string { return m[1] }, args[3:4], nil)
+			So(e, ShouldBeNil)
+			So(r[0], ShouldEqual, "one")
+		})
+
+		Convey("Times", func() {
+			r, e := cumin(func(t time.Time) int { return t.Year() }, args[4:5], nil)
+			So(e, ShouldBeNil)
+			So(r[0], ShouldEqual, 2015)
+		})
+
+		Convey("Pointers and slices of structs", func() {
+			r, e := cumin(func(p []*person) string { return p[0].Name }, args[5:6], nil)
+			So(e, ShouldBeNil)
+			So(r[0], ShouldEqual, "carol")
+		})
+	})
+
+	Convey("Handlers cannot take", t, func() {
+		Convey("Structs from lists", func() {
+			_, e := cumin(func(p person) {}, args[1:2], nil)
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Typed maps with mismatched values", func() {
+			_, e := cumin(func(m map[string]bool) {}, args[2:3], nil)
+			So(e, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCuminErrors(t *testing.T) {
+	Convey("Functions that return an error", t, func() {
+		Convey("Should not return a nil error as a result", func() {
+			r, e := cumin(func() (int, error) { return 1, nil }, []interface{}{}, nil)
+
+			So(e, ShouldBeNil)
+			So(r, ShouldResemble, []interface{}{1})
+		})
+
+		Convey("Should have their error returned", func() {
+			failure := NewError("xs.error.nope", "reason")
+			_, e := cumin(func() (int, error) { return 0, failure }, []interface{}{}, nil)
+
+			So(e, ShouldEqual, failure)
+		})
+	})
+
+	Convey("Functions that panic", t, func() {
+		Convey("Should fail with a runtime error", func() {
+			_, e := cumin(func() { panic("oh no") }, []interface{}{}, nil)
+
+			So(e, ShouldHaveSameTypeAs, &Error{})
+			So(e.(*Error).URI, ShouldEqual, ErrRuntimeError)
+			So(e.(*Error).Args, ShouldResemble, []interface{}{"oh no"})
+		})
+	})
+
+	Convey("Bad arguments", t, func() {
+		Convey("Should be reported as invalid arguments", func() {
+			_, e := cumin(oneNone, []interface{}{"one"}, nil)
+
+			So(e, ShouldHaveSameTypeAs, &Error{})
+			So(e.(*Error).URI, ShouldEqual, ErrInvalidArgument)
+		})
+	})
+}
+
+type person struct {
+	Name   string `json:"name"`
+	Age    int
+	Tags   []string `json:"tags,omitempty"`
+	Secret string   `json:"-"`
+	Friend *person  `json:"friend"`
+}
+
 // Functions for cuminication
 func noneNone()     {}
 func oneNone(a int) {}
+
+func oneKwargs(a int, kw Kwargs) int {
+	b, _ := kw["b"].(int)
+	return a * b
+}
+
+func TestCuminNumbers(t *testing.T) {
+	Convey("Handlers taking numbers", t, func() {
+		Convey("Accept whole floats", func() {
+			_, e := cumin(func(i int) {}, []interface{}{float64(2)}, nil)
+			So(e, ShouldBeNil)
+		})
+
+		Convey("Accept json numbers", func() {
+			ret, e := cumin(func(i int) int { return i }, []interface{}{json.Number("42")}, nil)
+			So(e, ShouldBeNil)
+			So(ret[0], ShouldEqual, 42)
+		})
+
+		Convey("Keep ids past 2^53 exact", func() {
+			ret, e := cumin(func(i uint64) uint64 { return i }, []interface{}{json.Number("9007199254740993")}, nil)
+			So(e, ShouldBeNil)
+			So(ret[0], ShouldEqual, uint64(9007199254740993))
+		})
+
+		Convey("Refuse values that overflow", func() {
+			_, e := cumin(func(b uint8) {}, []interface{}{int64(300)}, nil)
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Refuse negative values for unsigned params", func() {
+			_, e := cumin(func(u uint) {}, []interface{}{int64(-1)}, nil)
+			So(e, ShouldNotBeNil)
+		})
+
+		Convey("Refuse fractions for integer params", func() {
+			_, e := cumin(func(i int) {}, []interface{}{1.5}, nil)
+			So(e, ShouldNotBeNil)
+		})
+	})
+}
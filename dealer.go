@@ -0,0 +1,397 @@
+package goriffle
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// The dealer routes calls to an agent that registered the procedure, and the
+// results back to the caller
+type dealer struct {
+	// exact procedure -> registration
+	procedures map[string]*registration
+	// prefix and wildcard registrations, which have to be checked one by one
+	patterns      map[uint]*registration
+	registrations map[uint]*registration
+	// invocation request id -> call waiting on the callee
+	calls map[uint]*pendingCall
+	lock  sync.Mutex
+}
+
+// A procedure, or pattern of procedures, and the callees that share it
+type registration struct {
+	id        uint
+	procedure string
+	match     string
+	invoke    string
+	callees   []*agent
+	// the callee round robin invocation goes to next
+	next int
+	// callees that want to know who is calling
+	disclose map[*agent]bool
+}
+
+type pendingCall struct {
+	caller  *agent
+	request uint
+	callee  *agent
+	// the caller cancelled and is waiting for the callee to stop
+	killed bool
+}
+
+func newDealer() *dealer {
+	return &dealer{
+		procedures:    make(map[string]*registration),
+		patterns:      make(map[uint]*registration),
+		registrations: make(map[uint]*registration),
+		calls:         make(map[uint]*pendingCall),
+	}
+}
+
+// Register the callee for the procedure. Callees can share a procedure if
+// they all ask for the same invocation policy, and it isn't "single".
+func (d *dealer) register(callee *agent, msg *register) {
+	match, _ := msg.Options["match"].(string)
+	if match == "" {
+		match = "exact"
+	}
+	invoke, _ := msg.Options["invoke"].(string)
+	if invoke == "" {
+		invoke = "single"
+	}
+
+	if !validMatch(match) || !validInvoke(invoke) {
+		callee.deliver(nodeError(rEGISTER, msg.Request, ErrInvalidArgument))
+		return
+	}
+
+	d.lock.Lock()
+	reg := d.registrationFor(msg.Domain, match)
+	if reg == nil {
+		reg = &registration{id: newID(), procedure: msg.Domain, match: match, invoke: invoke, disclose: make(map[*agent]bool)}
+		d.registrations[reg.id] = reg
+		if match == "exact" {
+			d.procedures[reg.procedure] = reg
+		} else {
+			d.patterns[reg.id] = reg
+		}
+	} else if reg.invoke != invoke {
+		d.lock.Unlock()
+		callee.deliver(nodeError(rEGISTER, msg.Request, ErrDifferentInvokePolicy))
+		return
+	} else if invoke == "single" || reg.has(callee) {
+		d.lock.Unlock()
+		callee.deliver(nodeError(rEGISTER, msg.Request, ErrDomainAlreadyExists))
+		return
+	}
+
+	reg.callees = append(reg.callees, callee)
+	if disclose, _ := msg.Options["disclose_caller"].(bool); disclose {
+		reg.disclose[callee] = true
+	}
+	d.lock.Unlock()
+
+	callee.deliver(&registered{Request: msg.Request, Registration: reg.id})
+}
+
+func (d *dealer) unregister(callee *agent, msg *unregister) {
+	d.lock.Lock()
+	reg, ok := d.registrations[msg.Registration]
+	if ok && reg.has(callee) {
+		d.drop(reg, callee)
+	} else {
+		ok = false
+	}
+	d.lock.Unlock()
+
+	if !ok {
+		callee.deliver(nodeError(uNREGISTER, msg.Request, ErrNoSuchRegistration))
+		return
+	}
+
+	callee.deliver(&unregistered{Request: msg.Request})
+}
+
+// Pass the call on to one of the procedure's callees as an invocation
+func (d *dealer) call(caller *agent, msg *call) {
+	d.lock.Lock()
+	reg := d.lookup(msg.Domain)
+	if reg == nil {
+		d.lock.Unlock()
+		caller.deliver(nodeError(cALL, msg.Request, ErrNoSuchDomain))
+		return
+	}
+
+	request := newID()
+	callee := reg.pick()
+	disclose := reg.disclose[callee]
+	d.calls[request] = &pendingCall{caller: caller, request: msg.Request, callee: callee}
+	d.lock.Unlock()
+
+	details := make(map[string]interface{})
+	if progress, _ := msg.Options["receive_progress"].(bool); progress {
+		details["receive_progress"] = true
+	}
+
+	if discloseMe, _ := msg.Options["disclose_me"].(bool); discloseMe || disclose {
+		details["caller"] = caller.id
+		details["caller_authid"] = caller.domain
+		details["caller_authrole"] = caller.authrole
+	}
+
+	if timeout, ok := msg.Options["timeout"]; ok {
+		details["timeout"] = timeout
+	}
+
+	// Callees of a pattern are told which procedure was actually called
+	if reg.match != "exact" {
+		details["procedure"] = msg.Domain
+	}
+
+	callee.deliver(&invocation{
+		Request:      request,
+		Registration: reg.id,
+		Details:      details,
+		Arguments:    msg.Arguments,
+		ArgumentsKw:  msg.ArgumentsKw,
+	})
+}
+
+// The registration for exactly this procedure and match policy. Caller must hold the lock.
+func (d *dealer) registrationFor(procedure, match string) *registration {
+	if match == "exact" {
+		return d.procedures[procedure]
+	}
+
+	for _, reg := range d.patterns {
+		if reg.procedure == procedure && reg.match == match {
+			return reg
+		}
+	}
+	return nil
+}
+
+// The registration a call to the procedure goes to: an exact registration if
+// there is one, then the longest matching prefix, then the longest matching
+// wildcard. Caller must hold the lock.
+func (d *dealer) lookup(procedure string) *registration {
+	if reg, ok := d.procedures[procedure]; ok {
+		return reg
+	}
+
+	var best *registration
+	for _, reg := range d.patterns {
+		if !matchEndpoint(reg.procedure, procedure, reg.match) {
+			continue
+		}
+
+		if best == nil || reg.match == "prefix" && best.match == "wildcard" ||
+			reg.match == best.match && len(reg.procedure) > len(best.procedure) {
+			best = reg
+		}
+	}
+	return best
+}
+
+func (r *registration) has(callee *agent) bool {
+	for _, c := range r.callees {
+		if c == callee {
+			return true
+		}
+	}
+	return false
+}
+
+// Choose the callee for the next invocation. Caller must hold the lock.
+func (r *registration) pick() *agent {
+	switch r.invoke {
+	case "roundrobin":
+		callee := r.callees[r.next%len(r.callees)]
+		r.next = (r.next + 1) % len(r.callees)
+		return callee
+	case "random":
+		return r.callees[rand.Intn(len(r.callees))]
+	case "last":
+		return r.callees[len(r.callees)-1]
+	default:
+		return r.callees[0]
+	}
+}
+
+func validMatch(match string) bool {
+	return match == "exact" || match == "prefix" || match == "wildcard"
+}
+
+func validInvoke(invoke string) bool {
+	switch invoke {
+	case "single", "roundrobin", "random", "first", "last":
+		return true
+	}
+	return false
+}
+
+// The caller gave up on a call. Unless it asked to skip, the callee is
+// interrupted. When killing, the caller hears back once the callee stops,
+// otherwise right away and whatever the callee comes back with is dropped.
+func (d *dealer) cancel(caller *agent, msg *cancel) {
+	mode, _ := msg.Options["mode"].(string)
+
+	d.lock.Lock()
+	var request uint
+	var c *pendingCall
+	for r, pending := range d.calls {
+		if pending.caller == caller && pending.request == msg.Request {
+			request, c = r, pending
+			break
+		}
+	}
+
+	if c == nil || c.killed {
+		d.lock.Unlock()
+		return
+	}
+
+	if CancelMode(mode) == CancelKill {
+		c.killed = true
+	} else {
+		delete(d.calls, request)
+	}
+	d.lock.Unlock()
+
+	if CancelMode(mode) == CancelKill || CancelMode(mode) == CancelKillNoWait {
+		c.callee.deliver(&interrupt{Request: request, Options: map[string]interface{}{"mode": mode}})
+	}
+
+	if CancelMode(mode) != CancelKill {
+		caller.deliver(nodeError(cALL, msg.Request, ErrCanceled))
+	}
+}
+
+// Pass the callee's result back to the caller. Progressive results leave the
+// call open for more.
+func (d *dealer) yield(callee *agent, msg *yield) {
+	details := make(map[string]interface{})
+
+	var c pendingCall
+	var ok bool
+	if isProgress(msg.Options) {
+		details["progress"] = true
+		c, ok = d.pending(callee, msg.Request)
+	} else {
+		c, ok = d.complete(callee, msg.Request)
+	}
+
+	if !ok || (c.killed && isProgress(msg.Options)) {
+		return
+	} else if c.killed {
+		c.caller.deliver(nodeError(cALL, c.request, ErrCanceled))
+		return
+	}
+
+	c.caller.deliver(&result{
+		Request:     c.request,
+		Details:     details,
+		Arguments:   msg.Arguments,
+		ArgumentsKw: msg.ArgumentsKw,
+	})
+}
+
+// Pass an error from the callee back to the caller
+func (d *dealer) error(callee *agent, msg *errorMessage) {
+	if msg.Type != iNVOCATION {
+		return
+	}
+
+	c, ok := d.complete(callee, msg.Request)
+	if !ok {
+		return
+	} else if c.killed {
+		c.caller.deliver(nodeError(cALL, c.request, ErrCanceled))
+		return
+	}
+
+	c.caller.deliver(&errorMessage{
+		Type:        cALL,
+		Request:     c.request,
+		Details:     msg.Details,
+		Error:       msg.Error,
+		Arguments:   msg.Arguments,
+		ArgumentsKw: msg.ArgumentsKw,
+	})
+}
+
+// Take the pending call for an invocation the callee has answered. Returns a
+// copy, since cancel may still be changing the original.
+func (d *dealer) complete(callee *agent, request uint) (pendingCall, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.calls[request]
+	if !ok || c.callee != callee {
+		return pendingCall{}, false
+	}
+
+	delete(d.calls, request)
+	return *c, true
+}
+
+// Look up the pending call for an invocation the callee is still working on.
+// Returns a copy, since cancel may still be changing the original.
+func (d *dealer) pending(callee *agent, request uint) (pendingCall, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, ok := d.calls[request]
+	if !ok || c.callee != callee {
+		return pendingCall{}, false
+	}
+	return *c, true
+}
+
+// Drop the agent's registrations, failing any calls it was still working on
+func (d *dealer) remove(a *agent) {
+	d.lock.Lock()
+	for _, reg := range d.registrations {
+		if reg.has(a) {
+			d.drop(reg, a)
+		}
+	}
+
+	var orphaned []*pendingCall
+	for request, c := range d.calls {
+		if c.callee == a {
+			orphaned = append(orphaned, c)
+			delete(d.calls, request)
+		} else if c.caller == a {
+			delete(d.calls, request)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, c := range orphaned {
+		c.caller.deliver(nodeError(cALL, c.request, ErrCanceled))
+	}
+}
+
+// Take the callee off a registration, forgetting the registration once no
+// callees are left. Caller must hold the lock.
+func (d *dealer) drop(reg *registration, callee *agent) {
+	for i, c := range reg.callees {
+		if c == callee {
+			reg.callees = append(reg.callees[:i:i], reg.callees[i+1:]...)
+			break
+		}
+	}
+
+	delete(reg.disclose, callee)
+	if len(reg.callees) > 0 {
+		reg.next %= len(reg.callees)
+		return
+	}
+
+	if d.procedures[reg.procedure] == reg {
+		delete(d.procedures, reg.procedure)
+	}
+	delete(d.patterns, reg.id)
+	delete(d.registrations, reg.id)
+}
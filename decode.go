@@ -0,0 +1,314 @@
+package goriffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Convert a deserialized argument to the type a handler or caller asked for.
+//
+// Serializers only produce generic values: numbers, strings, bools, lists as
+// []interface{} and dicts as map[string]interface{}. These are decoded
+// recursively into typed slices, arrays and maps, pointers, time.Time (from
+// RFC 3339 strings or unix seconds), and structs, whose fields are matched to
+// dict keys by their json tag or, failing that, their name.
+func convertArg(arg interface{}, param reflect.Type) (reflect.Value, error) {
+	if arg == nil {
+		switch param.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map:
+			return reflect.Zero(param), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected %s, got nil", param)
+	}
+
+	val := reflect.ValueOf(arg)
+
+	if val.Type() == param {
+		return val, nil
+	} else if val.Type().AssignableTo(param) {
+		dst := reflect.New(param).Elem()
+		dst.Set(val)
+		return dst, nil
+	}
+
+	if param == timeType {
+		return decodeTime(val)
+	}
+
+	switch param.Kind() {
+	case reflect.Ptr:
+		elem, err := convertArg(arg, param.Elem())
+		if err != nil {
+			return val, err
+		}
+		ptr := reflect.New(param.Elem())
+		ptr.Elem().Set(elem)
+		return ptr, nil
+
+	case reflect.Struct:
+		if val.Kind() == reflect.Map {
+			return decodeStruct(val, param)
+		}
+
+	case reflect.Slice:
+		if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+			dst := reflect.MakeSlice(param, val.Len(), val.Len())
+			return dst, decodeElems(dst, val)
+		}
+
+	case reflect.Array:
+		if val.Kind() == reflect.Slice || val.Kind() == reflect.Array {
+			if val.Len() != param.Len() {
+				return val, fmt.Errorf("expected %d elements for %s, got %d", param.Len(), param, val.Len())
+			}
+			dst := reflect.New(param).Elem()
+			return dst, decodeElems(dst, val)
+		}
+
+	case reflect.Map:
+		if val.Kind() == reflect.Map {
+			return decodeMap(val, param)
+		}
+	}
+
+	if n, ok := arg.(json.Number); ok && isNumber(param.Kind()) {
+		val = reflect.ValueOf(numberValue(n))
+	}
+
+	if isNumber(val.Kind()) && isNumber(param.Kind()) {
+		return convertNumber(val, param)
+	}
+
+	if val.Type().ConvertibleTo(param) {
+		return val.Convert(param), nil
+	}
+
+	return val, fmt.Errorf("expected %s, got %s", param, val.Type())
+}
+
+// Convert between numeric kinds, refusing values the destination can't hold
+// rather than letting them wrap around or lose their fraction
+func convertNumber(val reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	dst := reflect.New(typ).Elem()
+	overflow := fmt.Errorf("%v does not fit in %s", val.Interface(), typ)
+
+	switch {
+	case isInt(typ.Kind()):
+		var n int64
+		switch {
+		case isInt(val.Kind()):
+			n = val.Int()
+		case isUint(val.Kind()):
+			if val.Uint() > math.MaxInt64 {
+				return dst, overflow
+			}
+			n = int64(val.Uint())
+		default:
+			f := val.Float()
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return dst, overflow
+			}
+			n = int64(f)
+		}
+
+		if dst.OverflowInt(n) {
+			return dst, overflow
+		}
+		dst.SetInt(n)
+
+	case isUint(typ.Kind()):
+		var n uint64
+		switch {
+		case isInt(val.Kind()):
+			if val.Int() < 0 {
+				return dst, overflow
+			}
+			n = uint64(val.Int())
+		case isUint(val.Kind()):
+			n = val.Uint()
+		default:
+			f := val.Float()
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 {
+				return dst, overflow
+			}
+			n = uint64(f)
+		}
+
+		if dst.OverflowUint(n) {
+			return dst, overflow
+		}
+		dst.SetUint(n)
+
+	default:
+		var f float64
+		switch {
+		case isInt(val.Kind()):
+			f = float64(val.Int())
+		case isUint(val.Kind()):
+			f = float64(val.Uint())
+		default:
+			f = val.Float()
+		}
+
+		if dst.OverflowFloat(f) {
+			return dst, overflow
+		}
+		dst.SetFloat(f)
+	}
+
+	return dst, nil
+}
+
+// The exact value of a jSON number: int64 for whole numbers that fit, uint64
+// for larger whole numbers, and float64 for everything else
+func numberValue(n json.Number) interface{} {
+	if i, err := n.Int64(); err == nil {
+		return i
+	} else if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u
+	}
+
+	f, _ := n.Float64()
+	return f
+}
+
+func isNumber(k reflect.Kind) bool {
+	return isInt(k) || isUint(k) || k == reflect.Float32 || k == reflect.Float64
+}
+
+func isInt(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUint(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+// Decode each element of src into the matching element of dst
+func decodeElems(dst, src reflect.Value) error {
+	for i := 0; i < src.Len(); i++ {
+		v, err := convertArg(src.Index(i).Interface(), dst.Type().Elem())
+		if err != nil {
+			return fmt.Errorf("[%d]: %s", i, err)
+		}
+		dst.Index(i).Set(v)
+	}
+	return nil
+}
+
+func decodeMap(src reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	dst := reflect.MakeMapWithSize(typ, src.Len())
+
+	for _, k := range src.MapKeys() {
+		key, err := decodeKey(k.Interface(), typ.Key())
+		if err != nil {
+			return dst, fmt.Errorf("key '%v': %s", k.Interface(), err)
+		}
+
+		v, err := convertArg(src.MapIndex(k).Interface(), typ.Elem())
+		if err != nil {
+			return dst, fmt.Errorf("[%v]: %s", k.Interface(), err)
+		}
+		dst.SetMapIndex(key, v)
+	}
+	return dst, nil
+}
+
+// Dict keys arrive as strings, even when the map wants numbers
+func decodeKey(key interface{}, typ reflect.Type) (reflect.Value, error) {
+	s, ok := key.(string)
+	if !ok || typ.Kind() == reflect.String {
+		return convertArg(key, typ)
+	}
+
+	dst := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, typ.Bits())
+		if err != nil {
+			return dst, err
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, typ.Bits())
+		if err != nil {
+			return dst, err
+		}
+		dst.SetUint(n)
+	default:
+		return convertArg(key, typ)
+	}
+	return dst, nil
+}
+
+func decodeStruct(src reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	dst := reflect.New(typ).Elem()
+
+	// Index the dict by key, case insensitively like encoding/json does
+	entries := make(map[string]reflect.Value, src.Len())
+	for _, k := range src.MapKeys() {
+		if name, ok := k.Interface().(string); ok {
+			entries[strings.ToLower(name)] = src.MapIndex(k)
+		}
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := fieldName(field)
+		if name == "" {
+			continue
+		}
+
+		entry, ok := entries[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+
+		v, err := convertArg(entry.Interface(), field.Type)
+		if err != nil {
+			return dst, fmt.Errorf("field %s: %s", field.Name, err)
+		}
+		dst.Field(i).Set(v)
+	}
+	return dst, nil
+}
+
+// The dict key a struct field is stored under, or "" if it is skipped
+func fieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+
+	if name := strings.Split(tag, ",")[0]; name != "" {
+		return name
+	}
+	return field.Name
+}
+
+func decodeTime(val reflect.Value) (reflect.Value, error) {
+	switch val.Kind() {
+	case reflect.String:
+		t, err := time.Parse(time.RFC3339Nano, val.String())
+		return reflect.ValueOf(t), err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(time.Unix(val.Int(), 0)), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.ValueOf(time.Unix(int64(val.Uint()), 0)), nil
+	case reflect.Float32, reflect.Float64:
+		sec := val.Float()
+		return reflect.ValueOf(time.Unix(int64(sec), int64((sec-float64(int64(sec)))*1e9))), nil
+	}
+	return val, fmt.Errorf("expected a time, got %s", val.Type())
+}
@@ -130,3 +130,53 @@ func breakdownEndpoint(s string) (string, string, error) {
 
 	return d, a, nil
 }
+
+// Checks if an endpoint is covered by a pattern under the given match policy.
+// Prefix patterns match any endpoint that starts with them. Wildcard patterns
+// match endpoints with the same number of components, where an empty or "*"
+// component in the pattern matches anything.
+//
+// Example:
+// matchEndpoint("xs.app", "xs.app.a/status", "prefix") -> true
+// matchEndpoint("xs.app.*/status", "xs.app.a/status", "wildcard") -> true
+// matchEndpoint("xs.app.*/status", "xs.app.a.b/status", "wildcard") -> false
+func matchEndpoint(pattern, endpoint, policy string) bool {
+	switch policy {
+	case "prefix":
+		return strings.HasPrefix(endpoint, pattern)
+	case "wildcard":
+		return matchWildcard(pattern, endpoint)
+	default:
+		return pattern == endpoint
+	}
+}
+
+func matchWildcard(pattern, endpoint string) bool {
+	patternDomain, patternAction, errPattern := breakdownEndpoint(pattern)
+	domain, action, err := breakdownEndpoint(endpoint)
+
+	// Without actions on both sides compare the whole thing as a domain
+	if errPattern != nil || err != nil {
+		return matchComponents(pattern, endpoint, DOMAIN_SEPARATOR)
+	}
+
+	return matchComponents(patternDomain, domain, DOMAIN_SEPARATOR) &&
+		matchComponents(patternAction, action, ACTION_SEPARATOR)
+}
+
+func matchComponents(pattern, s, separator string) bool {
+	patternParts := strings.Split(pattern, separator)
+	parts := strings.Split(s, separator)
+
+	if len(patternParts) != len(parts) {
+		return false
+	}
+
+	for i, p := range patternParts {
+		if p != "" && p != "*" && p != parts[i] {
+			return false
+		}
+	}
+
+	return true
+}
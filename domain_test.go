@@ -115,3 +115,41 @@ func TestDownwardAction(t *testing.T) {
 		})
 	})
 }
+
+func TestMatchEndpoint(t *testing.T) {
+	Convey("Exact patterns", t, func() {
+		Convey("Only match the same endpoint", func() {
+			So(matchEndpoint("xs.app/status", "xs.app/status", "exact"), ShouldBeTrue)
+			So(matchEndpoint("xs.app/status", "xs.app/statuses", "exact"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Prefix patterns", t, func() {
+		Convey("Match endpoints that start with them", func() {
+			So(matchEndpoint("xs.app", "xs.app.a/status", "prefix"), ShouldBeTrue)
+			So(matchEndpoint("xs.app/stat", "xs.app/status", "prefix"), ShouldBeTrue)
+			So(matchEndpoint("xs.app", "xs.other/status", "prefix"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Wildcard patterns", t, func() {
+		Convey("Match any domain in place of a wildcard", func() {
+			So(matchEndpoint("xs.app.*/status", "xs.app.a/status", "wildcard"), ShouldBeTrue)
+			So(matchEndpoint("xs.app./status", "xs.app.b/status", "wildcard"), ShouldBeTrue)
+		})
+
+		Convey("Match any action in place of a wildcard", func() {
+			So(matchEndpoint("xs.app.a/*", "xs.app.a/status", "wildcard"), ShouldBeTrue)
+		})
+
+		Convey("Need the same number of components", func() {
+			So(matchEndpoint("xs.app.*/status", "xs.app.a.b/status", "wildcard"), ShouldBeFalse)
+			So(matchEndpoint("xs.app.*/status", "xs.app.a/status/more", "wildcard"), ShouldBeFalse)
+		})
+
+		Convey("Match the rest of the endpoint exactly", func() {
+			So(matchEndpoint("xs.app.*/status", "xs.app.a/other", "wildcard"), ShouldBeFalse)
+			So(matchEndpoint("xs.*.a/status", "pd.app.a/status", "wildcard"), ShouldBeFalse)
+		})
+	})
+}
@@ -1,5 +1,9 @@
 package goriffle
 
+import (
+	"fmt"
+)
+
 type RealmExistsError string
 
 func (e RealmExistsError) Error() string {
@@ -24,6 +28,44 @@ func (e InvalidURIError) Error() string {
 	return "invalid URI: " + string(e)
 }
 
+// Error is a WAMP error. Handlers return one to answer a call with a specific
+// error URI, along with any arguments describing what went wrong.
+type Error struct {
+	URI    string
+	Args   []interface{}
+	Kwargs Kwargs
+}
+
+// NewError creates an Error with the given URI. A trailing Kwargs argument is
+// sent as keyword arguments.
+func NewError(uri string, args ...interface{}) *Error {
+	args, kwargs := splitKwargs(args)
+	return &Error{URI: uri, Args: args, Kwargs: kwargs}
+}
+
+func (e *Error) Error() string {
+	if len(e.Args) == 0 {
+		return e.URI
+	}
+	return fmt.Sprintf("%s: %v", e.URI, e.Args)
+}
+
+// CallError is returned from a call when the procedure answered with an error
+type CallError struct {
+	Procedure string
+	URI       string
+	Args      []interface{}
+	Kwargs    Kwargs
+}
+
+func (e *CallError) Error() string {
+	s := fmt.Sprintf("error calling procedure '%v': %v", e.Procedure, e.URI)
+	if len(e.Args) > 0 {
+		s += fmt.Sprintf(": %v", e.Args)
+	}
+	return s
+}
+
 const (
 	// --- Interactions ---
 
@@ -39,6 +81,10 @@ const (
 	// is already registered.
 	ErrDomainAlreadyExists = "wamp.error.procedure_already_exists"
 
+	// A procedure could not be registered, since it is already registered with
+	// a different invocation policy.
+	ErrDifferentInvokePolicy = "wamp.error.procedure_exists_with_different_invocation_policy"
+
 	// A Dealer could not perform an unregister, since the given registration is
 	// not active.
 	ErrNoSuchRegistration = "wamp.error.no_such_registration"
@@ -54,6 +100,13 @@ const (
 	// conform - in which case the Node may throw this error.
 	ErrInvalidArgument = "wamp.error.invalid_argument"
 
+	// A procedure failed without saying why in terms of a more specific URI.
+	ErrRuntimeError = "wamp.error.runtime_error"
+
+	// A call was cancelled by the caller, or abandoned because the callee went
+	// away before answering.
+	ErrCanceled = "wamp.error.canceled"
+
 	// --- Session Close ---
 
 	// The Connection is shutting down completely - used as a GOODBYE (or aBORT) reason.
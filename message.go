@@ -351,13 +351,6 @@ func (msg *event) messageType() messageType {
 	return eVENT
 }
 
-// CallResult represents the result of a cALL.
-type callResult struct {
-	Args   []interface{}
-	Kwargs map[string]interface{}
-	Err    string
-}
-
 // [cALL, Request|id, Options|dict, Domain|uri]
 // [cALL, Request|id, Options|dict, Domain|uri, Arguments|list]
 // [cALL, Request|id, Options|dict, Domain|uri, Arguments|list, ArgumentsKw|dict]
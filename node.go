@@ -0,0 +1,244 @@
+package goriffle
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Node is an in-process router. It accepts connections from agents, sorts
+// them into realms and routes publications and calls between them, so tests
+// and single binary deployments can run without a remote node.
+//
+// An agent joins with its own domain, and lands in the realm of the closest
+// ancestor domain the node has a realm for: with a realm for "xs", agents
+// "xs.alpha" and "xs.beta.gamma" can talk to each other.
+type Node struct {
+	// How long a new connection has to say hello before it is dropped
+	HandshakeTimeout time.Duration
+
+	realms  map[string]*realm
+	lock    sync.RWMutex
+	closing bool
+}
+
+type realm struct {
+	domain string
+	broker *broker
+	dealer *dealer
+	agents map[uint]*agent
+	lock   sync.Mutex
+}
+
+// An agent is a single session connected to the node. It is known by the
+// domain it joined as, which doubles as its authid.
+type agent struct {
+	connection
+	id       uint
+	domain   string
+	authrole string
+}
+
+// The role of agents that joined without authenticating
+const defaultAuthRole = "anonymous"
+
+// NewNode creates a node with no realms
+func NewNode() *Node {
+	return &Node{
+		HandshakeTimeout: 5 * time.Second,
+		realms:           make(map[string]*realm),
+	}
+}
+
+// AddRealm opens a realm for the given domain and all of its subdomains
+func (n *Node) AddRealm(domain string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.realms[domain]; ok {
+		return RealmExistsError(domain)
+	}
+
+	n.realms[domain] = &realm{
+		domain: domain,
+		broker: newBroker(),
+		dealer: newDealer(),
+		agents: make(map[uint]*agent),
+	}
+	return nil
+}
+
+// Accept waits for the agent on the other end of the connection to say hello.
+// If it asked for a domain the node has a realm for, it is welcomed and
+// its messages routed in the background until it leaves.
+func (n *Node) Accept(conn connection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.HandshakeTimeout)
+	defer cancel()
+
+	msg, err := getMessageContext(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	hello, ok := msg.(*hello)
+	if !ok {
+		conn.Send(abortUnexpectedMsg)
+		conn.Close()
+		return fmt.Errorf(formatUnexpectedMessage(msg, hELLO))
+	}
+
+	r, err := n.realmFor(hello.Realm)
+	if err != nil {
+		conn.Send(&abort{Details: map[string]interface{}{}, Reason: ErrNoSuchRealm})
+		conn.Close()
+		return err
+	}
+
+	a := &agent{connection: conn, id: newID(), domain: hello.Realm, authrole: defaultAuthRole}
+
+	welcome := &welcome{
+		Id: a.id,
+		Details: map[string]interface{}{
+			"authid":   a.domain,
+			"authrole": a.authrole,
+			"roles": map[string]interface{}{
+				"broker": map[string]interface{}{},
+				"dealer": map[string]interface{}{},
+			},
+		},
+	}
+
+	if err := a.Send(welcome); err != nil {
+		conn.Close()
+		return err
+	}
+
+	r.join(a)
+	go r.handle(a)
+	return nil
+}
+
+// Close says goodbye to every agent and stops accepting new ones
+func (n *Node) Close() error {
+	n.lock.Lock()
+	n.closing = true
+	realms := make([]*realm, 0, len(n.realms))
+	for _, r := range n.realms {
+		realms = append(realms, r)
+	}
+	n.lock.Unlock()
+
+	for _, r := range realms {
+		r.close()
+	}
+	return nil
+}
+
+// Find the realm with the longest domain the given domain falls under
+func (n *Node) realmFor(domain string) (*realm, error) {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	if n.closing {
+		return nil, fmt.Errorf("node is shutting down")
+	}
+
+	var found *realm
+	for d, r := range n.realms {
+		if subdomain(d, domain) && (found == nil || len(d) > len(found.domain)) {
+			found = r
+		}
+	}
+
+	if found == nil {
+		return nil, NoSuchRealmError(domain)
+	}
+	return found, nil
+}
+
+func (r *realm) join(a *agent) {
+	r.lock.Lock()
+	r.agents[a.id] = a
+	r.lock.Unlock()
+}
+
+// Route messages from the agent until it leaves or its connection drops
+func (r *realm) handle(a *agent) {
+	for msg := range a.Receive() {
+		switch msg := msg.(type) {
+
+		case *goodbye:
+			a.Send(&goodbye{Details: map[string]interface{}{}, Reason: ErrGoodbyeAndOut})
+			a.Close()
+
+		case *publish:
+			r.broker.publish(a, msg)
+		case *subscribe:
+			r.broker.subscribe(a, msg)
+		case *unsubscribe:
+			r.broker.unsubscribe(a, msg)
+
+		case *register:
+			r.dealer.register(a, msg)
+		case *unregister:
+			r.dealer.unregister(a, msg)
+		case *call:
+			r.dealer.call(a, msg)
+		case *cancel:
+			r.dealer.cancel(a, msg)
+		case *yield:
+			r.dealer.yield(a, msg)
+		case *errorMessage:
+			r.dealer.error(a, msg)
+
+		default:
+			log.Println("node: unhandled message from agent:", msg.messageType(), a.domain)
+		}
+	}
+
+	r.leave(a)
+}
+
+// Forget everything the agent had going in this realm
+func (r *realm) leave(a *agent) {
+	r.lock.Lock()
+	delete(r.agents, a.id)
+	r.lock.Unlock()
+
+	r.broker.remove(a)
+	r.dealer.remove(a)
+}
+
+func (r *realm) close() {
+	r.lock.Lock()
+	agents := make([]*agent, 0, len(r.agents))
+	for _, a := range r.agents {
+		agents = append(agents, a)
+	}
+	r.lock.Unlock()
+
+	for _, a := range agents {
+		a.Send(&goodbye{Details: map[string]interface{}{}, Reason: ErrSystemShutdown})
+		a.Close()
+	}
+}
+
+// Send a message to an agent, logging instead of failing
+func (a *agent) deliver(msg message) {
+	if err := a.Send(msg); err != nil {
+		log.Println("node: error sending to agent:", a.domain, err)
+	}
+}
+
+// Build the error reply to a request the node could not fulfil
+func nodeError(typ messageType, request uint, uri string) *errorMessage {
+	return &errorMessage{
+		Type:    typ,
+		Request: request,
+		Details: make(map[string]interface{}),
+		Error:   uri,
+	}
+}
@@ -0,0 +1,106 @@
+package goriffle
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNodeRealms(t *testing.T) {
+	Convey("A node with a realm", t, func() {
+		n := NewNode()
+		So(n.AddRealm("xs"), ShouldBeNil)
+
+		Convey("Will not open it twice", func() {
+			So(n.AddRealm("xs"), ShouldEqual, RealmExistsError("xs"))
+		})
+
+		Convey("Welcomes agents from its subdomains", func() {
+			conn := newTestConnection()
+			conn.in <- &hello{Realm: "xs.damouse", Details: map[string]interface{}{}}
+
+			So(n.Accept(conn), ShouldBeNil)
+			_, ok := (<-conn.out).(*welcome)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Turns away agents from other domains", func() {
+			conn := newTestConnection()
+			conn.in <- &hello{Realm: "pd.damouse", Details: map[string]interface{}{}}
+
+			So(n.Accept(conn), ShouldEqual, NoSuchRealmError("pd.damouse"))
+			a, ok := (<-conn.out).(*abort)
+			So(ok, ShouldBeTrue)
+			So(a.Reason, ShouldEqual, ErrNoSuchRealm)
+		})
+	})
+}
+
+func TestNodeRouting(t *testing.T) {
+	Convey("Agents joined to a node", t, func() {
+		n := NewNode()
+		n.AddRealm("xs")
+
+		alpha := joinTestAgent(n, "xs.alpha")
+		beta := joinTestAgent(n, "xs.beta")
+
+		Convey("Receive publications from other agents", func() {
+			alpha.in <- &subscribe{Request: 1, Options: map[string]interface{}{}, Domain: "xs.beta/sub"}
+			sub := (<-alpha.out).(*subscribed)
+			beta.in <- &subscribe{Request: 2, Options: map[string]interface{}{}, Domain: "xs.beta/sub"}
+			<-beta.out
+
+			beta.in <- &publish{Request: 3, Options: map[string]interface{}{}, Domain: "xs.beta/sub", Arguments: []interface{}{1}}
+
+			evt := (<-alpha.out).(*event)
+			So(evt.Subscription, ShouldEqual, sub.Subscription)
+			So(evt.Arguments, ShouldResemble, []interface{}{1})
+
+			Convey("But not their own", func() {
+				So(len(beta.out), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Have calls routed to the registering agent", func() {
+			beta.in <- &register{Request: 1, Options: map[string]interface{}{}, Domain: "xs.beta/add"}
+			reg := (<-beta.out).(*registered)
+
+			alpha.in <- &call{Request: 2, Options: map[string]interface{}{}, Domain: "xs.beta/add", Arguments: []interface{}{1, 2}}
+			inv := (<-beta.out).(*invocation)
+			So(inv.Registration, ShouldEqual, reg.Registration)
+			So(inv.Arguments, ShouldResemble, []interface{}{1, 2})
+
+			beta.in <- &yield{Request: inv.Request, Options: map[string]interface{}{}, Arguments: []interface{}{3}}
+			res := (<-alpha.out).(*result)
+			So(res.Request, ShouldEqual, 2)
+			So(res.Arguments, ShouldResemble, []interface{}{3})
+		})
+
+		Convey("Get an error calling procedures nobody registered", func() {
+			alpha.in <- &call{Request: 1, Options: map[string]interface{}{}, Domain: "xs.beta/nothing"}
+			e := (<-alpha.out).(*errorMessage)
+			So(e.Error, ShouldEqual, ErrNoSuchDomain)
+		})
+
+		Convey("Cannot register a procedure twice", func() {
+			beta.in <- &register{Request: 1, Options: map[string]interface{}{}, Domain: "xs.beta/add"}
+			<-beta.out
+			alpha.in <- &register{Request: 2, Options: map[string]interface{}{}, Domain: "xs.beta/add"}
+			e := (<-alpha.out).(*errorMessage)
+			So(e.Error, ShouldEqual, ErrDomainAlreadyExists)
+		})
+
+		Reset(func() {
+			n.Close()
+		})
+	})
+}
+
+// Say hello to the node over a test connection, swallowing the welcome
+func joinTestAgent(n *Node, domain string) *testConnection {
+	conn := newTestConnection()
+	conn.in <- &hello{Realm: domain, Details: map[string]interface{}{}}
+	n.Accept(conn)
+	<-conn.out
+	return conn
+}
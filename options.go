@@ -0,0 +1,224 @@
+package goriffle
+
+import (
+	"reflect"
+	"time"
+)
+
+// MatchPolicy decides how a subscription's topic is matched against the
+// topics events are published to
+type MatchPolicy string
+
+const (
+	// Only the topic itself. The default.
+	MatchExact MatchPolicy = "exact"
+	// Any topic that starts with the given one.
+	MatchPrefix MatchPolicy = "prefix"
+	// Any topic with the same components, where empty or "*" components match
+	// anything. For example "xs.app.*/status" matches "xs.app.a/status".
+	MatchWildcard MatchPolicy = "wildcard"
+)
+
+// SubscribeOptions control which events a subscription receives. Handlers of
+// pattern subscriptions can learn the actual topic through *EventDetails.
+type SubscribeOptions struct {
+	Match MatchPolicy
+}
+
+// The options dict for a sUBSCRIBE message
+func (o *SubscribeOptions) options() map[string]interface{} {
+	options := make(map[string]interface{})
+	if o != nil && o.Match != "" && o.Match != MatchExact {
+		options["match"] = string(o.Match)
+	}
+	return options
+}
+
+// InvokePolicy decides which of the callees sharing a procedure a call goes to
+type InvokePolicy string
+
+const (
+	// The procedure can't be shared. The default.
+	InvokeSingle InvokePolicy = "single"
+	// Each callee in turn.
+	InvokeRoundRobin InvokePolicy = "roundrobin"
+	// Any callee, at random.
+	InvokeRandom InvokePolicy = "random"
+	// The callee that registered first.
+	InvokeFirst InvokePolicy = "first"
+	// The callee that registered last.
+	InvokeLast InvokePolicy = "last"
+)
+
+// RegisterOptions control how a procedure is registered. Every callee sharing
+// a procedure has to register it with the same invocation policy.
+type RegisterOptions struct {
+	Invoke InvokePolicy
+	// Handlers of pattern registrations can learn the procedure that was
+	// actually called through *InvocationDetails.
+	Match MatchPolicy
+	// Have the node tell the handler who is calling, through *InvocationDetails
+	DiscloseCaller bool
+}
+
+// The options dict for a rEGISTER message
+func (o *RegisterOptions) options() map[string]interface{} {
+	options := make(map[string]interface{})
+	if o == nil {
+		return options
+	}
+
+	if o.Invoke != "" && o.Invoke != InvokeSingle {
+		options["invoke"] = string(o.Invoke)
+	}
+	if o.Match != "" && o.Match != MatchExact {
+		options["match"] = string(o.Match)
+	}
+	if o.DiscloseCaller {
+		options["disclose_caller"] = true
+	}
+	return options
+}
+
+// PublishOptions control who receives a publication and what they learn
+// about who sent it
+type PublishOptions struct {
+	// Deliver the event to the publisher too, if it is subscribed to the topic
+	IncludeMe bool
+
+	// Only deliver to sessions that match one of these. Empty lists don't restrict.
+	Eligible         []uint
+	EligibleAuthID   []string
+	EligibleAuthRole []string
+
+	// Never deliver to sessions that match one of these
+	Exclude         []uint
+	ExcludeAuthID   []string
+	ExcludeAuthRole []string
+
+	// Tell subscribers who published the event
+	DiscloseMe bool
+
+	// Have the node acknowledge the publication
+	Acknowledge bool
+}
+
+// The options dict for a pUBLISH message
+func (o *PublishOptions) options() map[string]interface{} {
+	options := make(map[string]interface{})
+	if o == nil {
+		return options
+	}
+
+	if o.IncludeMe {
+		options["exclude_me"] = false
+	}
+	if o.DiscloseMe {
+		options["disclose_me"] = true
+	}
+	if o.Acknowledge {
+		options["acknowledge"] = true
+	}
+
+	setList(options, "eligible", o.Eligible)
+	setList(options, "eligible_authid", o.EligibleAuthID)
+	setList(options, "eligible_authrole", o.EligibleAuthRole)
+	setList(options, "exclude", o.Exclude)
+	setList(options, "exclude_authid", o.ExcludeAuthID)
+	setList(options, "exclude_authrole", o.ExcludeAuthRole)
+	return options
+}
+
+// EventDetails describe an event. A subscription handler that declares an
+// *EventDetails parameter is handed one with each event it receives.
+type EventDetails struct {
+	Publication uint
+	// The topic the event was published to
+	Topic string
+
+	// Who published the event. Only set if the publisher disclosed itself.
+	Publisher         uint
+	PublisherAuthID   string
+	PublisherAuthRole string
+}
+
+func newEventDetails(topic string, msg *event) *EventDetails {
+	d := &EventDetails{
+		Publication:       msg.Publication,
+		Topic:             topic,
+		Publisher:         detailID(msg.Details, "publisher"),
+		PublisherAuthID:   detailString(msg.Details, "publisher_authid"),
+		PublisherAuthRole: detailString(msg.Details, "publisher_authrole"),
+	}
+
+	if t := detailString(msg.Details, "topic"); t != "" {
+		d.Topic = t
+	}
+	return d
+}
+
+// InvocationDetails describe a call to a procedure. A registered handler that
+// declares an *InvocationDetails parameter is handed one with each call.
+type InvocationDetails struct {
+	// The procedure that was called
+	Procedure string
+
+	// Who made the call. Only set if the caller disclosed itself, or the
+	// procedure was registered with DiscloseCaller.
+	Caller         uint
+	CallerAuthID   string
+	CallerAuthRole string
+
+	// How long the caller is willing to wait for the result. Zero if it didn't say.
+	Timeout time.Duration
+}
+
+func newInvocationDetails(procedure string, msg *invocation) *InvocationDetails {
+	d := &InvocationDetails{
+		Procedure:      procedure,
+		Caller:         detailID(msg.Details, "caller"),
+		CallerAuthID:   detailString(msg.Details, "caller_authid"),
+		CallerAuthRole: detailString(msg.Details, "caller_authrole"),
+		Timeout:        time.Duration(detailID(msg.Details, "timeout")) * time.Millisecond,
+	}
+
+	if p := detailString(msg.Details, "procedure"); p != "" {
+		d.Procedure = p
+	}
+	return d
+}
+
+// Add a list to an options dict, if it has anything in it
+func setList(options map[string]interface{}, key string, list interface{}) {
+	val := reflect.ValueOf(list)
+	if val.Len() == 0 {
+		return
+	}
+
+	l := make([]interface{}, val.Len())
+	for i := range l {
+		l[i] = val.Index(i).Interface()
+	}
+	options[key] = l
+}
+
+// Read an id out of a details or options dict, whatever number type the serializer used
+func detailID(details map[string]interface{}, key string) uint {
+	var id uint
+	if v, ok := details[key]; ok {
+		decodeInto(v, &id)
+	}
+	return id
+}
+
+func detailString(details map[string]interface{}, key string) string {
+	s, _ := details[key].(string)
+	return s
+}
+
+// Read a list of ids or strings out of a details or options dict
+func detailList(details map[string]interface{}, key string, dst interface{}) {
+	if v, ok := details[key]; ok {
+		decodeInto(v, dst)
+	}
+}
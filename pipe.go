@@ -0,0 +1,108 @@
+package goriffle
+
+import (
+	"fmt"
+	"sync"
+)
+
+// One end of an in-memory pipe. Messages sent on one end arrive on the other
+// in the order they were sent, without ever blocking the sender.
+type localConnection struct {
+	peer       *localConnection
+	serializer serializer
+	messages   chan message
+	queue      []message
+	closed     bool
+	lock       sync.Mutex
+	cond       *sync.Cond
+}
+
+// Create two linked connections. If s is not nil every message is serialized
+// and deserialized on its way through, so anything that would not survive a
+// real transport doesn't survive the pipe either.
+func pipe(s serializer) (connection, connection) {
+	a, b := newLocalConnection(s), newLocalConnection(s)
+	a.peer, b.peer = b, a
+
+	go a.run()
+	go b.run()
+	return a, b
+}
+
+func newLocalConnection(s serializer) *localConnection {
+	c := &localConnection{
+		serializer: s,
+		messages:   make(chan message, 10),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *localConnection) Send(msg message) error {
+	if c.serializer != nil {
+		b, err := c.serializer.serialize(msg)
+		if err != nil {
+			return err
+		}
+
+		if msg, err = c.serializer.deserialize(b); err != nil {
+			return err
+		}
+	}
+
+	return c.peer.enqueue(msg)
+}
+
+func (c *localConnection) Receive() <-chan message {
+	return c.messages
+}
+
+// Closes both ends of the pipe. Messages already sent are still delivered.
+func (c *localConnection) Close() error {
+	c.shut()
+	c.peer.shut()
+	return nil
+}
+
+func (c *localConnection) shut() {
+	c.lock.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+func (c *localConnection) enqueue(msg message) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return fmt.Errorf("connection closed")
+	}
+
+	c.queue = append(c.queue, msg)
+	c.cond.Signal()
+	return nil
+}
+
+// Move queued messages onto the receive channel, closing it once the
+// connection is closed and the queue drained
+func (c *localConnection) run() {
+	for {
+		c.lock.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+
+		if len(c.queue) == 0 {
+			c.lock.Unlock()
+			close(c.messages)
+			return
+		}
+
+		msg := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+
+		c.messages <- msg
+	}
+}
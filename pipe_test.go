@@ -0,0 +1,451 @@
+package goriffle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPipe(t *testing.T) {
+	Convey("A pipe", t, func() {
+		a, b := pipe(nil)
+
+		Convey("Delivers messages in order", func() {
+			for i := 0; i < 100; i++ {
+				So(a.Send(&published{Request: uint(i)}), ShouldBeNil)
+			}
+
+			for i := 0; i < 100; i++ {
+				So((<-b.Receive()).(*published).Request, ShouldEqual, i)
+			}
+		})
+
+		Convey("Works both ways", func() {
+			b.Send(&published{Request: 1})
+			So((<-a.Receive()).(*published).Request, ShouldEqual, 1)
+		})
+
+		Convey("Closes both ends after delivering what was sent", func() {
+			a.Send(goodbyeSession)
+			a.Close()
+
+			_, ok := (<-b.Receive()).(*goodbye)
+			So(ok, ShouldBeTrue)
+
+			_, open := <-b.Receive()
+			So(open, ShouldBeFalse)
+			_, open = <-a.Receive()
+			So(open, ShouldBeFalse)
+
+			So(b.Send(goodbyeSession), ShouldNotBeNil)
+		})
+	})
+
+	Convey("A pipe with a serializer", t, func() {
+		a, b := pipe(new(jSONSerializer))
+
+		Convey("Passes messages through it", func() {
+			a.Send(&call{Request: 1, Options: map[string]interface{}{}, Domain: "xs.a/b", Arguments: []interface{}{1}})
+
+			c := (<-b.Receive()).(*call)
+			So(c.Domain, ShouldEqual, "xs.a/b")
+			So(c.Arguments, ShouldResemble, []interface{}{int64(1)})
+		})
+	})
+}
+
+func TestLocalSessions(t *testing.T) {
+	Convey("Sessions joined to a local node", t, func() {
+		n := NewNode()
+		n.AddRealm("xs")
+
+		server, err := StartLocal(n, "xs.gotestserver")
+		So(err, ShouldBeNil)
+		go server.Receive()
+
+		client, err := StartLocal(n, "xs.gotestclient")
+		So(err, ShouldBeNil)
+		go client.Receive()
+
+		Convey("Can call each other", func() {
+			So(server.Register("xs.gotestserver/hello", func(a, b int) int { return a + b }, nil), ShouldBeNil)
+
+			ret, err := client.Call("xs.gotestserver/hello", 2, 3)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{5})
+		})
+
+		Convey("Can decode results into typed values", func() {
+			So(server.Register("xs.gotestserver/hello", func(a, b int) int { return a + b }, nil), ShouldBeNil)
+
+			results, err := client.CallResults("xs.gotestserver/hello", 2, 3)
+			So(err, ShouldBeNil)
+
+			var sum int
+			So(results.Decode(&sum), ShouldBeNil)
+			So(sum, ShouldEqual, 5)
+		})
+
+		Convey("Can stream progressive results", func() {
+			count := func(n int, progress Progress) int {
+				for i := 1; i < n; i++ {
+					progress(i)
+				}
+				return n
+			}
+			So(server.Register("xs.gotestserver/count", count, nil), ShouldBeNil)
+
+			var partial []int
+			ret, err := client.CallProgress("xs.gotestserver/count", func(i int) { partial = append(partial, i) }, 4)
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{4})
+			So(partial, ShouldResemble, []int{1, 2, 3})
+
+			Convey("Without holding up the session while the caller is busy with them", func() {
+				So(server.Register("xs.gotestserver/hello", func(a, b int) int { return a + b }, nil), ShouldBeNil)
+
+				started, release := make(chan bool, 1), make(chan bool)
+				streamed := make(chan error, 1)
+				go func() {
+					_, err := client.CallProgress("xs.gotestserver/count", func(i int) {
+						if i == 1 {
+							started <- true
+						}
+						<-release
+					}, 40)
+					streamed <- err
+				}()
+
+				<-started
+				// Let the rest of the stream pile up behind the busy handler
+				time.Sleep(10 * time.Millisecond)
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				ret, err := client.CallContext(ctx, "xs.gotestserver/hello", 2, 3)
+				So(err, ShouldBeNil)
+				So(ret, ShouldResemble, []interface{}{5})
+
+				close(release)
+				So(<-streamed, ShouldBeNil)
+			})
+
+			Convey("Only if the caller asks for them", func() {
+				ret, err := client.Call("xs.gotestserver/count", 4)
+				So(err, ShouldBeNil)
+				So(ret, ShouldResemble, []interface{}{4})
+			})
+		})
+
+		Convey("Can cancel calls", func() {
+			interrupted := make(chan bool, 1)
+			wait := func(ctx context.Context, d float64) error {
+				select {
+				case <-ctx.Done():
+					interrupted <- true
+					return ctx.Err()
+				case <-time.After(time.Duration(d) * time.Millisecond):
+					interrupted <- false
+					return nil
+				}
+			}
+			So(server.Register("xs.gotestserver/wait", wait, nil), ShouldBeNil)
+
+			call := func(mode CancelMode) error {
+				ctx, cancel := context.WithTimeout(WithCancelMode(context.Background(), mode), 10*time.Millisecond)
+				defer cancel()
+				_, err := client.CallContext(ctx, "xs.gotestserver/wait", 200)
+				return err
+			}
+
+			Convey("Interrupting the callee when killing them", func() {
+				So(errors.Is(call(CancelKill), context.DeadlineExceeded), ShouldBeTrue)
+				So(<-interrupted, ShouldBeTrue)
+			})
+
+			Convey("Interrupting the callee without waiting on it", func() {
+				So(errors.Is(call(CancelKillNoWait), context.DeadlineExceeded), ShouldBeTrue)
+				So(<-interrupted, ShouldBeTrue)
+			})
+
+			Convey("Leaving the callee alone when skipping them", func() {
+				So(errors.Is(call(CancelSkip), context.DeadlineExceeded), ShouldBeTrue)
+				So(<-interrupted, ShouldBeFalse)
+			})
+
+			Convey("Killing callees that are streaming progressive results", func() {
+				stream := func(ctx context.Context, progress Progress) error {
+					for {
+						select {
+						case <-ctx.Done():
+							interrupted <- true
+							return ctx.Err()
+						default:
+							progress(1)
+						}
+					}
+				}
+				So(server.Register("xs.gotestserver/stream", stream, nil), ShouldBeNil)
+
+				ctx, cancel := context.WithTimeout(WithCancelMode(context.Background(), CancelKill), 5*time.Millisecond)
+				defer cancel()
+				_, err := client.CallProgressContext(ctx, "xs.gotestserver/stream", func(i int) {})
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+				So(<-interrupted, ShouldBeTrue)
+			})
+
+			Convey("Waiting for streaming callees to stop when killing them", func() {
+				stopped := make(chan struct{})
+				stream := func(ctx context.Context, progress Progress) error {
+					for {
+						select {
+						case <-ctx.Done():
+							time.Sleep(50 * time.Millisecond)
+							close(stopped)
+							return ctx.Err()
+						default:
+							progress(1)
+						}
+					}
+				}
+				So(server.Register("xs.gotestserver/stream", stream, nil), ShouldBeNil)
+
+				ctx, cancel := context.WithTimeout(WithCancelMode(context.Background(), CancelKill), 5*time.Millisecond)
+				defer cancel()
+				_, err := client.CallProgressContext(ctx, "xs.gotestserver/stream", func(i int) {})
+				So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+
+				select {
+				case <-stopped:
+				default:
+					So("returned before the callee stopped", ShouldBeEmpty)
+				}
+			})
+		})
+
+		Convey("Can share procedures between callees", func() {
+			worker, err := StartLocal(n, "xs.gotestworker")
+			So(err, ShouldBeNil)
+			go worker.Receive()
+
+			opts := &RegisterOptions{Invoke: InvokeRoundRobin}
+			So(server.RegisterWithOptions("xs.gotestserver/work", opts, func() string { return "server" }), ShouldBeNil)
+			So(worker.RegisterWithOptions("xs.gotestserver/work", opts, func() string { return "worker" }), ShouldBeNil)
+
+			var handled []interface{}
+			for i := 0; i < 4; i++ {
+				ret, err := client.Call("xs.gotestserver/work")
+				So(err, ShouldBeNil)
+				handled = append(handled, ret...)
+			}
+			So(handled, ShouldResemble, []interface{}{"server", "worker", "server", "worker"})
+
+			Convey("Only with the same invocation policy", func() {
+				So(client.RegisterWithOptions("xs.gotestserver/work", &RegisterOptions{Invoke: InvokeRandom}, func() {}), ShouldNotBeNil)
+				So(client.Register("xs.gotestserver/work", func() {}, nil), ShouldNotBeNil)
+			})
+		})
+
+		Convey("Can register procedures matching a pattern", func() {
+			get := func(d *InvocationDetails) string { return d.Procedure }
+			So(server.RegisterWithOptions("xs.gotestserver.*/get", &RegisterOptions{Match: MatchWildcard}, get), ShouldBeNil)
+
+			ret, err := client.Call("xs.gotestserver.a/get")
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"xs.gotestserver.a/get"})
+
+			_, err = client.Call("xs.gotestserver.a/put")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Can tell who is calling", func() {
+			got := make(chan *InvocationDetails, 1)
+			who := func(d *InvocationDetails) { got <- d }
+			So(server.RegisterWithOptions("xs.gotestserver/who", &RegisterOptions{DiscloseCaller: true}, who), ShouldBeNil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err := client.CallContext(ctx, "xs.gotestserver/who")
+			So(err, ShouldBeNil)
+
+			details := <-got
+			So(details.Procedure, ShouldEqual, "xs.gotestserver/who")
+			So(details.Caller, ShouldNotEqual, 0)
+			So(details.CallerAuthID, ShouldEqual, "xs.gotestclient")
+			So(details.CallerAuthRole, ShouldEqual, "anonymous")
+			So(details.Timeout, ShouldBeGreaterThan, 0)
+			So(details.Timeout, ShouldBeLessThanOrEqualTo, time.Second)
+
+			Convey("Only if the procedure asks", func() {
+				So(server.Register("xs.gotestserver/anyone", who, nil), ShouldBeNil)
+				_, err := client.Call("xs.gotestserver/anyone")
+				So(err, ShouldBeNil)
+				So((<-got).Caller, ShouldEqual, 0)
+			})
+		})
+
+		Convey("Can call each other with keyword arguments", func() {
+			greet := func(name string, kw Kwargs) (string, Kwargs) {
+				return kw["greeting"].(string) + " " + name, Kwargs{"polite": true}
+			}
+			So(server.Register("xs.gotestserver/greet", greet, nil), ShouldBeNil)
+
+			ret, err := client.Call("xs.gotestserver/greet", "bob", Kwargs{"greeting": "hi"})
+			So(err, ShouldBeNil)
+			So(ret, ShouldResemble, []interface{}{"hi bob", Kwargs{"polite": true}})
+		})
+
+		Convey("Get errors back from the procedures they call", func() {
+			fail := func(a int) (int, error) {
+				if a < 0 {
+					return 0, NewError(ErrInvalidArgument, "negative", Kwargs{"got": a})
+				}
+				return 0, fmt.Errorf("broken")
+			}
+			So(server.Register("xs.gotestserver/fail", fail, nil), ShouldBeNil)
+
+			var ce *CallError
+			_, err := client.Call("xs.gotestserver/fail", -1)
+			So(errors.As(err, &ce), ShouldBeTrue)
+			So(ce.URI, ShouldEqual, ErrInvalidArgument)
+			So(ce.Args, ShouldResemble, []interface{}{"negative"})
+			So(ce.Kwargs, ShouldResemble, Kwargs{"got": -1})
+
+			_, err = client.Call("xs.gotestserver/fail", 1)
+			So(errors.As(err, &ce), ShouldBeTrue)
+			So(ce.URI, ShouldEqual, ErrRuntimeError)
+
+			_, err = client.Call("xs.gotestserver/fail", "one")
+			So(errors.As(err, &ce), ShouldBeTrue)
+			So(ce.URI, ShouldEqual, ErrInvalidArgument)
+
+			_, err = client.Call("xs.gotestserver/nothing")
+			So(errors.As(err, &ce), ShouldBeTrue)
+			So(ce.URI, ShouldEqual, ErrNoSuchDomain)
+		})
+
+		Convey("Can publish to each other", func() {
+			got := make(chan int, 1)
+			So(server.Subscribe("xs.gotestserver/sub", func(a, b int) { got <- a + b }), ShouldBeNil)
+
+			So(client.Publish("xs.gotestserver/sub", 4, 5), ShouldBeNil)
+			So(<-got, ShouldEqual, 9)
+		})
+
+		Convey("Can have their publications acknowledged", func() {
+			got := make(chan int, 1)
+			So(server.Subscribe("xs.gotestserver/sub", func(a int) { got <- a }), ShouldBeNil)
+
+			id, err := client.PublishAck("xs.gotestserver/sub", 1)
+			So(err, ShouldBeNil)
+			So(id, ShouldNotEqual, 0)
+			So(<-got, ShouldEqual, 1)
+		})
+
+		Convey("Can publish to themselves", func() {
+			got := make(chan int, 1)
+			So(client.Subscribe("xs.gotestserver/sub", func(a int) { got <- a }), ShouldBeNil)
+
+			_, err := client.PublishWithOptions("xs.gotestserver/sub", &PublishOptions{IncludeMe: true, Acknowledge: true}, 3)
+			So(err, ShouldBeNil)
+			So(<-got, ShouldEqual, 3)
+		})
+
+		Convey("Can leave subscribers out of publications", func() {
+			got := make(chan string, 2)
+			So(server.Subscribe("xs.gotestserver/sub", func(s string) { got <- "server " + s }), ShouldBeNil)
+			So(client.Subscribe("xs.gotestserver/sub", func(s string) { got <- "client " + s }), ShouldBeNil)
+
+			opts := &PublishOptions{IncludeMe: true, ExcludeAuthID: []string{"xs.gotestserver"}}
+			_, err := client.PublishWithOptions("xs.gotestserver/sub", opts, "first")
+			So(err, ShouldBeNil)
+			So(<-got, ShouldEqual, "client first")
+
+			opts = &PublishOptions{IncludeMe: true, EligibleAuthID: []string{"xs.gotestserver"}}
+			_, err = client.PublishWithOptions("xs.gotestserver/sub", opts, "second")
+			So(err, ShouldBeNil)
+			So(<-got, ShouldEqual, "server second")
+		})
+
+		Convey("Can disclose themselves to subscribers", func() {
+			got := make(chan *EventDetails, 1)
+			So(server.Subscribe("xs.gotestserver/sub", func(d *EventDetails) { got <- d }), ShouldBeNil)
+
+			id, err := client.PublishWithOptions("xs.gotestserver/sub", &PublishOptions{DiscloseMe: true, Acknowledge: true})
+			So(err, ShouldBeNil)
+
+			details := <-got
+			So(details.Publication, ShouldEqual, id)
+			So(details.Topic, ShouldEqual, "xs.gotestserver/sub")
+			So(details.Publisher, ShouldNotEqual, 0)
+			So(details.PublisherAuthID, ShouldEqual, "xs.gotestclient")
+			So(details.PublisherAuthRole, ShouldEqual, "anonymous")
+		})
+
+		Convey("Can subscribe to topics matching a pattern", func() {
+			got := make(chan string, 2)
+			handler := func(d *EventDetails) { got <- d.Topic }
+
+			_, err := server.SubscribeWithOptions("xs.gotestserver.*/status", &SubscribeOptions{Match: MatchWildcard}, handler)
+			So(err, ShouldBeNil)
+			_, err = server.SubscribeWithOptions("xs.gotestserver.b", &SubscribeOptions{Match: MatchPrefix}, handler)
+			So(err, ShouldBeNil)
+
+			for _, topic := range []string{"xs.gotestserver.a/status", "xs.gotestserver.a/other", "xs.gotestserver.b/other"} {
+				_, err := client.PublishAck(topic)
+				So(err, ShouldBeNil)
+			}
+
+			topics := []string{<-got, <-got}
+			So(topics, ShouldContain, "xs.gotestserver.a/status")
+			So(topics, ShouldContain, "xs.gotestserver.b/other")
+		})
+
+		Convey("Can have several handlers on one topic", func() {
+			got := make(chan string, 2)
+			nodeSubscriptions := func() int {
+				b := n.realms["xs"].broker
+				b.lock.Lock()
+				defer b.lock.Unlock()
+				return len(b.subscriptions)
+			}
+			publish := func() {
+				_, err := client.PublishAck("xs.gotestserver/sub")
+				So(err, ShouldBeNil)
+			}
+
+			first, err := server.SubscribeWithOptions("xs.gotestserver/sub", nil, func() { got <- "first" })
+			So(err, ShouldBeNil)
+			second, err := server.SubscribeWithOptions("xs.gotestserver/sub", nil, func() { got <- "second" })
+			So(err, ShouldBeNil)
+			So(nodeSubscriptions(), ShouldEqual, 1)
+
+			publish()
+			handled := []string{<-got, <-got}
+			So(handled, ShouldContain, "first")
+			So(handled, ShouldContain, "second")
+
+			So(first.Unsubscribe(), ShouldBeNil)
+			So(nodeSubscriptions(), ShouldEqual, 1)
+			publish()
+			So(<-got, ShouldEqual, "second")
+
+			So(second.Unsubscribe(), ShouldBeNil)
+			So(nodeSubscriptions(), ShouldEqual, 0)
+			So(first.Unsubscribe(), ShouldNotBeNil)
+		})
+
+		Convey("Cannot join domains the node has no realm for", func() {
+			_, err := StartLocal(n, "pd.damouse")
+			So(err, ShouldNotBeNil)
+		})
+
+		Reset(func() {
+			n.Close()
+		})
+	})
+}
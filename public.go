@@ -47,7 +47,7 @@ func PSubscribe(s string) []byte {
 		fmt.Println("GR: error subscribing: ", e)
 	}
 
-	if i, _, ok := bindingForEndpoint(sess.events, s); ok {
+	if i, _, ok := sess.topicBindingFor(s); ok {
 		fmt.Println("Subscribed for endpoint: ", int(i))
 		return marshall(i)
 	} else {
@@ -59,7 +59,7 @@ func PSubscribe(s string) []byte {
 func PRegister(s string) []byte {
 	sess.Register(s, nil, map[string]interface{}{})
 
-	if i, _, ok := bindingForEndpoint(sess.procedures, s); ok {
+	if i, _, ok := sess.bindingFor(sess.procedures, s); ok {
 		fmt.Println("Registered for endpoint: ", int(i))
 		return marshall(i)
 	} else {
@@ -79,8 +79,9 @@ func PRecieve() []byte {
 
 		case *event:
 			return marshall(map[string]interface{}{
-				"id":   msg.Subscription,
-				"data": msg.Arguments,
+				"id":     msg.Subscription,
+				"data":   msg.Arguments,
+				"kwargs": msg.ArgumentsKw,
 			})
 
 		case *invocation:
@@ -90,11 +91,12 @@ func PRecieve() []byte {
 				"id":      msg.Registration,
 				"request": msg.Request,
 				"data":    msg.Arguments,
+				"kwargs":  msg.ArgumentsKw,
 			})
 
 		default:
 			log.Println("unhandled message:", msg.messageType(), msg)
-			panic("Unhandled message!")
+			return nil
 		}
 
 	case <-kill:
@@ -111,6 +113,7 @@ func PYield(args []byte) {
 	}
 
 	strRequest, status, result := dat["id"].(string), dat["ok"].(string), dat["result"].([]interface{})
+	kwargs, _ := dat["kwargs"].(map[string]interface{})
 	j, _ := strconv.ParseUint(strRequest, 10, 64)
 	request := uint(j)
 
@@ -119,9 +122,10 @@ func PYield(args []byte) {
 	var tosend message
 
 	tosend = &yield{
-		Request:   request,
-		Options:   make(map[string]interface{}),
-		Arguments: result,
+		Request:     request,
+		Options:     make(map[string]interface{}),
+		Arguments:   result,
+		ArgumentsKw: kwargs,
 	}
 
 	if status != "" {
@@ -158,7 +162,7 @@ func internalReceive() {
 		switch msg := msg.(type) {
 
 		case *event:
-			if _, ok := c.events[msg.Subscription]; ok {
+			if _, ok := c.eventHandlers(msg.Subscription); ok {
 				mem <- msg
 
 			} else {
@@ -166,13 +170,15 @@ func internalReceive() {
 			}
 
 		case *invocation:
-			if _, ok := c.procedures[msg.Registration]; ok {
+			if _, ok := c.binding(c.procedures, msg.Registration); ok {
 				mem <- msg
 
 			} else {
 				log.Println("no handler registered for registration:", msg.Registration)
 			}
 
+		case *published:
+			c.notifyListener(msg, msg.Request)
 		case *registered:
 			c.notifyListener(msg, msg.Request)
 		case *subscribed:
@@ -192,7 +198,6 @@ func internalReceive() {
 
 		default:
 			log.Println("unhandled message:", msg.messageType(), msg)
-			panic("Unhandled message!")
 		}
 	}
 
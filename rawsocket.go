@@ -0,0 +1,270 @@
+package goriffle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// WAMP RawSocket: after a 4 byte handshake that settles the serializer and the
+// longest message each side accepts, every message travels in a frame with a
+// 4 byte header holding the frame type and the payload length.
+// https://wamp-proto.org/wamp_latest_ietf.html#name-rawsocket-transport
+
+const (
+	rawSocketMagic = 0x7f
+
+	// Frame types
+	rawSocketMessage = 0
+	rawSocketPing    = 1
+	rawSocketPong    = 2
+
+	// Handshake errors
+	rawSocketErrSerializer = 1
+	rawSocketErrReserved   = 3
+
+	// The longest message we accept: 2^(9+15) bytes, less the one byte the
+	// frame header can't describe
+	rawSocketMaxLengthExp = 15
+
+	rawSocketHandshakeTimeout = 5 * time.Second
+)
+
+// Serializer ids used in the handshake
+var rawSocketSerializers = map[byte]Serialization{
+	1: jSON,
+	2: mSGPACK,
+	3: cBOR,
+}
+
+type rawSocketConnection struct {
+	conn       net.Conn
+	serializer serializer
+	messages   chan message
+	// the longest message the peer accepts
+	maxLength int
+	sendLock  sync.Mutex
+	closeOnce sync.Once
+}
+
+// Open a RawSocket to the node at the given address, asking for the given
+// serialization
+func dialRawSocket(network, address string, s Serialization) (connection, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := rawSocketSerializerID(s)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("serialization %d can't be used with rawsocket", s)
+	}
+
+	conn.SetDeadline(time.Now().Add(rawSocketHandshakeTimeout))
+	if _, err := conn.Write([]byte{rawSocketMagic, rawSocketMaxLengthExp<<4 | id, 0, 0}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	if reply[0] != rawSocketMagic {
+		conn.Close()
+		return nil, fmt.Errorf("rawsocket peer sent a bad handshake: %x", reply)
+	} else if reply[1]&0x0f == 0 {
+		conn.Close()
+		return nil, fmt.Errorf("rawsocket peer refused the handshake with error %d", reply[1]>>4)
+	} else if reply[1]&0x0f != id {
+		conn.Close()
+		return nil, fmt.Errorf("rawsocket peer chose serializer %d, asked for %d", reply[1]&0x0f, id)
+	}
+
+	return newRawSocketConnection(conn, s, reply[1]>>4), nil
+}
+
+// Answer the handshake of an agent that opened a RawSocket to us
+func acceptRawSocket(conn net.Conn) (connection, error) {
+	conn.SetDeadline(time.Now().Add(rawSocketHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var hello [4]byte
+	if _, err := io.ReadFull(conn, hello[:]); err != nil {
+		return nil, err
+	} else if hello[0] != rawSocketMagic {
+		return nil, fmt.Errorf("rawsocket peer sent a bad handshake: %x", hello)
+	} else if hello[2] != 0 || hello[3] != 0 {
+		conn.Write([]byte{rawSocketMagic, rawSocketErrReserved << 4, 0, 0})
+		return nil, fmt.Errorf("rawsocket peer used reserved bits: %x", hello)
+	}
+
+	id := hello[1] & 0x0f
+	s, ok := rawSocketSerializers[id]
+	if !ok {
+		conn.Write([]byte{rawSocketMagic, rawSocketErrSerializer << 4, 0, 0})
+		return nil, fmt.Errorf("rawsocket peer asked for unsupported serializer %d", id)
+	}
+
+	if _, err := conn.Write([]byte{rawSocketMagic, rawSocketMaxLengthExp<<4 | id, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	return newRawSocketConnection(conn, s, hello[1]>>4), nil
+}
+
+func newRawSocketConnection(conn net.Conn, s Serialization, maxLengthExp byte) *rawSocketConnection {
+	c := &rawSocketConnection{
+		conn:       conn,
+		serializer: s.serializer(),
+		messages:   make(chan message, 10),
+		maxLength:  rawSocketMaxLength(maxLengthExp),
+	}
+
+	go c.run()
+	return c
+}
+
+// The longest message a peer announcing the given length exponent accepts.
+// The frame header only has 24 bits for the length, so the largest exponent
+// comes out one byte short of its power of two.
+func rawSocketMaxLength(exp byte) int {
+	if max := 1 << (9 + int(exp)); max < 1<<24 {
+		return max
+	}
+	return 1<<24 - 1
+}
+
+// The first of the subprotocols RawSocket can speak, or JSON if there is none
+func rawSocketSerialization(subprotocols []string) Serialization {
+	for _, p := range subprotocols {
+		if s, ok := subprotocolSerialization(p); ok {
+			if _, ok := rawSocketSerializerID(s); ok {
+				return s
+			}
+		}
+	}
+	return jSON
+}
+
+func rawSocketSerializerID(s Serialization) (byte, bool) {
+	for id, ser := range rawSocketSerializers {
+		if ser == s {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+func (c *rawSocketConnection) Send(msg message) error {
+	b, err := c.serializer.serialize(msg)
+	if err != nil {
+		return err
+	}
+
+	if len(b) > c.maxLength {
+		return fmt.Errorf("message is %d bytes, rawsocket peer accepts at most %d", len(b), c.maxLength)
+	}
+
+	return c.writeFrame(rawSocketMessage, b)
+}
+
+func (c *rawSocketConnection) Receive() <-chan message {
+	return c.messages
+}
+
+func (c *rawSocketConnection) Close() error {
+	var err error
+	c.closeOnce.Do(func() { err = c.conn.Close() })
+	return err
+}
+
+func (c *rawSocketConnection) writeFrame(typ byte, payload []byte) error {
+	header := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	header[0] = typ
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// Read frames until the socket closes, answering pings along the way
+func (c *rawSocketConnection) run() {
+	defer close(c.messages)
+	defer c.Close()
+
+	maxLength := rawSocketMaxLength(rawSocketMaxLengthExp)
+	var header [4]byte
+
+	for {
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println("error reading from rawsocket peer:", err)
+			}
+			return
+		}
+
+		typ := header[0] & 0x07
+		length := int(binary.BigEndian.Uint32(header[:]) & 0xffffff)
+		if length > maxLength {
+			log.Println("rawsocket peer sent a message longer than allowed:", length)
+			return
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			log.Println("error reading from rawsocket peer:", err)
+			return
+		}
+
+		switch typ {
+		case rawSocketMessage:
+			if msg, err := c.serializer.deserialize(payload); err != nil {
+				log.Println("error deserializing peer message:", err)
+			} else {
+				c.messages <- msg
+			}
+		case rawSocketPing:
+			if err := c.writeFrame(rawSocketPong, payload); err != nil {
+				log.Println("error answering rawsocket ping:", err)
+			}
+		case rawSocketPong:
+		default:
+			log.Println("rawsocket peer sent a frame of unknown type:", typ)
+			return
+		}
+	}
+}
+
+// ServeRawSocket hands every agent that opens a RawSocket on the listener to
+// the node, until the listener is closed
+func (n *Node) ServeRawSocket(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			c, err := acceptRawSocket(conn)
+			if err != nil {
+				log.Println("rawsocket handshake failed:", err)
+				conn.Close()
+				return
+			}
+
+			n.Accept(c)
+		}()
+	}
+}
@@ -0,0 +1,130 @@
+package goriffle
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRawSocket(t *testing.T) {
+	Convey("A node serving RawSocket", t, func() {
+		n := NewNode()
+		n.AddRealm("xs")
+
+		serve := func(network, address string) net.Listener {
+			l, err := net.Listen(network, address)
+			So(err, ShouldBeNil)
+			go n.ServeRawSocket(l)
+			return l
+		}
+
+		Convey("Routes between sessions over TCP, whatever they serialize with", func() {
+			l := serve("tcp", "127.0.0.1:0")
+			Reset(func() { l.Close() })
+			url := "tcp://" + l.Addr().String()
+
+			server, err := StartWithConfig(url, "xs.gotestserver", nil)
+			So(err, ShouldBeNil)
+			go server.Receive()
+			So(server.Register("xs.gotestserver/hello", func(a, b int) int { return a + b }, nil), ShouldBeNil)
+
+			client, err := StartWithConfig(url, "xs.gotestclient", &Config{Subprotocols: []string{SubprotocolMsgpack}})
+			So(err, ShouldBeNil)
+			go client.Receive()
+
+			results, err := client.CallResults("xs.gotestserver/hello", 2, 3)
+			So(err, ShouldBeNil)
+			var sum int
+			So(results.Decode(&sum), ShouldBeNil)
+			So(sum, ShouldEqual, 5)
+		})
+
+		Convey("Routes between sessions over Unix sockets", func() {
+			dir, err := ioutil.TempDir("", "rawsocket")
+			So(err, ShouldBeNil)
+			l := serve("unix", filepath.Join(dir, "node.sock"))
+			Reset(func() {
+				l.Close()
+				os.RemoveAll(dir)
+			})
+
+			got := make(chan string, 1)
+			server, err := StartWithConfig("unix://"+l.Addr().String(), "xs.gotestserver", nil)
+			So(err, ShouldBeNil)
+			go server.Receive()
+			So(server.Subscribe("xs.gotestserver/sub", func(s string) { got <- s }), ShouldBeNil)
+
+			client, err := StartWithConfig("unix://"+l.Addr().String(), "xs.gotestclient", &Config{Subprotocols: []string{SubprotocolCBOR}})
+			So(err, ShouldBeNil)
+			go client.Receive()
+
+			_, err = client.PublishAck("xs.gotestserver/sub", "hi")
+			So(err, ShouldBeNil)
+			So(<-got, ShouldEqual, "hi")
+		})
+
+		Convey("Answers pings", func() {
+			l := serve("tcp", "127.0.0.1:0")
+			Reset(func() { l.Close() })
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			reply := make([]byte, 4)
+			conn.Write([]byte{rawSocketMagic, 0xf1, 0, 0})
+			io.ReadFull(conn, reply)
+			So(reply, ShouldResemble, []byte{rawSocketMagic, 0xf1, 0, 0})
+
+			conn.Write([]byte{rawSocketPing, 0, 0, 4, 'p', 'i', 'n', 'g'})
+			pong := make([]byte, 8)
+			io.ReadFull(conn, pong)
+			So(pong, ShouldResemble, []byte{rawSocketPong, 0, 0, 4, 'p', 'i', 'n', 'g'})
+		})
+
+		Convey("Refuses serializers it doesn't know", func() {
+			l := serve("tcp", "127.0.0.1:0")
+			Reset(func() { l.Close() })
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			defer conn.Close()
+
+			reply := make([]byte, 4)
+			conn.Write([]byte{rawSocketMagic, 0xf9, 0, 0})
+			io.ReadFull(conn, reply)
+			So(reply, ShouldResemble, []byte{rawSocketMagic, rawSocketErrSerializer << 4, 0, 0})
+		})
+
+		Reset(func() {
+			n.Close()
+		})
+	})
+}
+
+func TestRawSocketMaxLength(t *testing.T) {
+	Convey("The longest RawSocket message", t, func() {
+		Convey("Doubles with every step of the exponent", func() {
+			So(rawSocketMaxLength(0), ShouldEqual, 512)
+			So(rawSocketMaxLength(14), ShouldEqual, 1<<23)
+		})
+
+		Convey("Fits the 24 bit length header at the largest exponent", func() {
+			So(rawSocketMaxLength(15), ShouldEqual, 1<<24-1)
+		})
+
+		Convey("Is enforced when sending", func() {
+			local, remote := net.Pipe()
+			defer remote.Close()
+			c := newRawSocketConnection(local, jSON, 0)
+			defer c.Close()
+
+			So(c.Send(&publish{Request: 1, Options: map[string]interface{}{}, Domain: "xs.a/b", Arguments: []interface{}{string(make([]byte, 512))}}), ShouldNotBeNil)
+		})
+	})
+}
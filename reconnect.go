@@ -0,0 +1,94 @@
+package goriffle
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultReconnectMinDelay = 500 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
+)
+
+// Redial the node until a connection sticks, then rejoin the realm and
+// reissue all subscriptions and registrations held by this session.
+// Called from Receive once the old connection has gone away.
+func (c *session) reconnect() error {
+	if c.dial == nil {
+		return fmt.Errorf("session has no dialer, cannot reconnect")
+	}
+
+	for attempt := 0; c.ReconnectAttempts == 0 || attempt < c.ReconnectAttempts; attempt++ {
+		time.Sleep(backoff(attempt, c.ReconnectMinDelay, c.ReconnectMaxDelay))
+
+		if c.isLeaving() {
+			return fmt.Errorf("session is leaving")
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			log.Println("reconnect attempt failed:", err)
+			continue
+		}
+
+		c.connLock.Lock()
+		c.connection = conn
+		c.connLock.Unlock()
+
+		if _, err := c.JoinRealm(c.realm, c.details); err != nil {
+			log.Println("unable to rejoin realm:", err)
+			continue
+		}
+
+		// The old ids mean nothing to the node anymore
+		events, procedures := c.takeTopics(), c.takeBindings(c.procedures)
+
+		// Receive has to be running again for the replies to come through
+		go c.resume(events, procedures)
+		return nil
+	}
+
+	return fmt.Errorf("unable to reconnect after %d attempts", c.ReconnectAttempts)
+}
+
+// Reissue the given subscriptions and registrations on the current connection
+func (c *session) resume(events map[uint]*topicBinding, procedures map[uint]*boundEndpoint) {
+	for _, e := range events {
+		ctx, cancel := c.timeoutContext()
+		err := c.subscribeTopic(ctx, e)
+		cancel()
+
+		if err != nil {
+			log.Println("unable to resubscribe:", err)
+		}
+	}
+
+	for _, p := range procedures {
+		if err := c.Register(p.endpoint, p.handler, p.options); err != nil {
+			log.Println("unable to reregister:", err)
+		}
+	}
+}
+
+// The delay before the given reconnect attempt. Grows exponentially from min
+// up to max, and is then jittered down by up to half so a fleet of clients
+// dropped by the same node restart don't all come back at once.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := int64(delay / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
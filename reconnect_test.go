@@ -0,0 +1,122 @@
+package goriffle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, time.Second
+
+	Convey("Reconnect delays", t, func() {
+		Convey("Start around the minimum", func() {
+			d := backoff(0, min, max)
+			So(d, ShouldBeGreaterThanOrEqualTo, min/2)
+			So(d, ShouldBeLessThanOrEqualTo, min)
+		})
+
+		Convey("Grow exponentially", func() {
+			d := backoff(3, min, max)
+			So(d, ShouldBeGreaterThanOrEqualTo, 4*min)
+			So(d, ShouldBeLessThanOrEqualTo, 8*min)
+		})
+
+		Convey("Never exceed the maximum", func() {
+			for i := 0; i < 100; i++ {
+				So(backoff(i, min, max), ShouldBeLessThanOrEqualTo, max)
+			}
+		})
+	})
+}
+
+func TestReconnect(t *testing.T) {
+	Convey("A reconnecting session", t, func() {
+		first := newTestConnection()
+		second := newTestConnection()
+		topics := make(chan string, 4)
+
+		go fakeNode(first, 1, topics)
+		go fakeNode(second, 2, topics)
+
+		s := newSession(first)
+		s.Reconnect = true
+		s.ReconnectMinDelay = time.Millisecond
+		s.dial = func() (connection, error) { return second, nil }
+
+		_, err := s.JoinRealm("xs.test", nil)
+		So(err, ShouldBeNil)
+		go s.Receive()
+
+		got := make(chan int, 1)
+		So(s.Subscribe("xs.test/sub", func(a int) { got <- a }), ShouldBeNil)
+		So(<-topics, ShouldEqual, "xs.test/sub")
+
+		Convey("Resubscribes after the connection drops", func() {
+			first.Close()
+
+			select {
+			case topic := <-topics:
+				So(topic, ShouldEqual, "xs.test/sub")
+			case <-time.After(time.Second):
+				So("resubscribed", ShouldEqual, "timed out")
+			}
+
+			// Wait for the new subscription to be bound before publishing on it
+			for i := 0; i < 100; i++ {
+				if _, ok := s.eventHandlers(2); ok {
+					break
+				}
+
+				time.Sleep(time.Millisecond)
+			}
+
+			second.in <- &event{Subscription: 2, Details: map[string]interface{}{}, Arguments: []interface{}{7}}
+			So(<-got, ShouldEqual, 7)
+		})
+	})
+}
+
+// Channel backed connection that a test can play the node on
+type testConnection struct {
+	in   chan message
+	out  chan message
+	once sync.Once
+}
+
+func newTestConnection() *testConnection {
+	return &testConnection{
+		in:  make(chan message, 10),
+		out: make(chan message, 10),
+	}
+}
+
+func (c *testConnection) Send(msg message) error {
+	c.out <- msg
+	return nil
+}
+
+func (c *testConnection) Receive() <-chan message {
+	return c.in
+}
+
+func (c *testConnection) Close() error {
+	c.once.Do(func() { close(c.in) })
+	return nil
+}
+
+// Answers hellos and subscribes on the given connection, handing out subID
+// and reporting every subscribed topic
+func fakeNode(c *testConnection, subID uint, topics chan string) {
+	for msg := range c.out {
+		switch msg := msg.(type) {
+		case *hello:
+			c.in <- &welcome{Id: newID(), Details: map[string]interface{}{}}
+		case *subscribe:
+			c.in <- &subscribed{Request: msg.Request, Subscription: subID}
+			topics <- msg.Domain
+		}
+	}
+}
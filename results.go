@@ -0,0 +1,58 @@
+package goriffle
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Results are what a procedure returned to a call
+type Results struct {
+	Args   []interface{}
+	Kwargs Kwargs
+}
+
+// Decode stores the positional results in the values pointed to by dst, in
+// order, converting them the same way handler arguments are converted. There
+// must be exactly one pointer per result.
+func (r *Results) Decode(dst ...interface{}) error {
+	if len(dst) != len(r.Args) {
+		return fmt.Errorf("expected %d results, got %d", len(dst), len(r.Args))
+	}
+
+	for i, d := range dst {
+		if err := decodeInto(r.Args[i], d); err != nil {
+			return fmt.Errorf("result[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// DecodeKwarg stores the keyword result with the given name in the value
+// pointed to by dst.
+func (r *Results) DecodeKwarg(name string, dst interface{}) error {
+	v, ok := r.Kwargs[name]
+	if !ok {
+		return fmt.Errorf("no keyword result named %s", name)
+	}
+
+	if err := decodeInto(v, dst); err != nil {
+		return fmt.Errorf("result %s: %s", name, err)
+	}
+	return nil
+}
+
+// Convert val and store it in the value dst points to
+func decodeInto(val interface{}, dst interface{}) error {
+	ptr := reflect.ValueOf(dst)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() {
+		return fmt.Errorf("cannot decode into %T, need a non-nil pointer", dst)
+	}
+
+	v, err := convertArg(val, ptr.Elem().Type())
+	if err != nil {
+		return err
+	}
+
+	ptr.Elem().Set(v)
+	return nil
+}
@@ -0,0 +1,51 @@
+package goriffle
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResultsDecode(t *testing.T) {
+	Convey("Results", t, func() {
+		r := &Results{
+			Args:   []interface{}{float64(5), "five", []interface{}{"a", "b"}},
+			Kwargs: Kwargs{"count": int64(2)},
+		}
+
+		Convey("Decode into typed values", func() {
+			var n int
+			var s string
+			var l []string
+
+			So(r.Decode(&n, &s, &l), ShouldBeNil)
+			So(n, ShouldEqual, 5)
+			So(s, ShouldEqual, "five")
+			So(l, ShouldResemble, []string{"a", "b"})
+		})
+
+		Convey("Decode keyword results", func() {
+			var count uint
+			So(r.DecodeKwarg("count", &count), ShouldBeNil)
+			So(count, ShouldEqual, 2)
+			So(r.DecodeKwarg("missing", &count), ShouldNotBeNil)
+		})
+
+		Convey("Refuse the wrong number of values", func() {
+			var n int
+			So(r.Decode(&n), ShouldNotBeNil)
+		})
+
+		Convey("Refuse values of the wrong type", func() {
+			var n, m int
+			var l []string
+			So(r.Decode(&n, &m, &l), ShouldNotBeNil)
+		})
+
+		Convey("Refuse things that aren't pointers", func() {
+			var s string
+			var l []string
+			So(r.Decode(5, &s, &l), ShouldNotBeNil)
+		})
+	})
+}
@@ -1,12 +1,15 @@
 package goriffle
 
 import (
+	"bytes"
+	"encoding"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
 
+	"github.com/exis-io/browrilla"
 	"github.com/ugorji/go/codec"
 )
 
@@ -23,8 +26,48 @@ const (
 	jSON Serialization = iota
 	// Use msgpack-encoded strings as a payload.
 	mSGPACK
+	// Use CBOR-encoded strings as a payload.
+	cBOR
 )
 
+// The websocket subprotocols for each serialization
+const (
+	SubprotocolJSON    = "wamp.2.json"
+	SubprotocolMsgpack = "wamp.2.msgpack"
+	SubprotocolCBOR    = "wamp.2.cbor"
+)
+
+var defaultSubprotocols = []string{SubprotocolJSON, SubprotocolMsgpack}
+
+var subprotocolSerializations = map[string]Serialization{
+	SubprotocolJSON:    jSON,
+	SubprotocolMsgpack: mSGPACK,
+	SubprotocolCBOR:    cBOR,
+}
+
+func subprotocolSerialization(protocol string) (Serialization, bool) {
+	s, ok := subprotocolSerializations[protocol]
+	return s, ok
+}
+
+func (s Serialization) serializer() serializer {
+	switch s {
+	case mSGPACK:
+		return new(messagePackSerializer)
+	case cBOR:
+		return new(cborSerializer)
+	}
+	return new(jSONSerializer)
+}
+
+// Text serializations go in text frames, everything else in binary ones
+func (s Serialization) payloadType() int {
+	if s == jSON {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
 // applies a list of values from a WAMP message to a message type
 func apply(msgType messageType, arr []interface{}) (message, error) {
 	msg := msgType.New()
@@ -46,6 +89,12 @@ func apply(msgType messageType, arr []interface{}) (message, error) {
 		}
 		if arg.Type().AssignableTo(f.Type()) {
 			f.Set(arg)
+		} else if isNumber(arg.Kind()) && isNumber(f.Kind()) {
+			v, err := convertNumber(arg, f.Type())
+			if err != nil {
+				return nil, fmt.Errorf("Message format error: %dth field: %s", i+1, err)
+			}
+			f.Set(v)
 		} else if arg.Type().ConvertibleTo(f.Type()) {
 			f.Set(arg.Convert(f.Type()))
 		} else if f.Type().Kind() != arg.Type().Kind() {
@@ -67,6 +116,11 @@ func apply(msgType messageType, arr []interface{}) (message, error) {
 
 // attempts to convert a value to another; is a no-op if it's already assignable to the type
 func convert(val reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	// elements of generic lists and maps come wrapped in an interface
+	if val.Kind() == reflect.Interface && !val.IsNil() {
+		val = val.Elem()
+	}
+
 	valType := val.Type()
 	if !valType.AssignableTo(typ) {
 		if valType.ConvertibleTo(typ) {
@@ -144,16 +198,27 @@ func toList(msg message) []interface{} {
 type messagePackSerializer struct {
 }
 
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := new(codec.MsgpackHandle)
+	// Keep strings and binary data apart: []byte goes out as bin, and str comes
+	// back as string while bin comes back as []byte. RawToString would turn
+	// bin into strings as well, so it stays off.
+	h.WriteExt = true
+	// Dicts come back keyed by strings, as they would from jSON
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
 // Serialize encodes a Message into a msgpack payload.
 func (s *messagePackSerializer) serialize(msg message) ([]byte, error) {
 	var b []byte
-	return b, codec.NewEncoderBytes(&b, new(codec.MsgpackHandle)).Encode(toList(msg))
+	return b, codec.NewEncoderBytes(&b, newMsgpackHandle()).Encode(toList(msg))
 }
 
 // Deserialize decodes a msgpack payload into a Message.
 func (s *messagePackSerializer) deserialize(data []byte) (message, error) {
 	var arr []interface{}
-	if err := codec.NewDecoderBytes(data, new(codec.MsgpackHandle)).Decode(&arr); err != nil {
+	if err := codec.NewDecoderBytes(data, newMsgpackHandle()).Decode(&arr); err != nil {
 		return nil, err
 	} else if len(arr) == 0 {
 		return nil, fmt.Errorf("Invalid message")
@@ -169,6 +234,48 @@ func (s *messagePackSerializer) deserialize(data []byte) (message, error) {
 	return apply(msgType, arr)
 }
 
+// cborSerializer is an implementation of Serializer that handles serializing
+// and deserializing CBOR encoded payloads. Binary data travels as CBOR byte
+// strings, so unlike jSON it needs no special treatment.
+type cborSerializer struct {
+}
+
+func newCborHandle() *codec.CborHandle {
+	h := new(codec.CborHandle)
+	// Dicts come back keyed by strings, as they would from jSON
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+// Serialize encodes a Message into a CBOR payload.
+func (s *cborSerializer) serialize(msg message) ([]byte, error) {
+	var b []byte
+	return b, codec.NewEncoderBytes(&b, newCborHandle()).Encode(toList(msg))
+}
+
+// Deserialize decodes a CBOR payload into a Message.
+func (s *cborSerializer) deserialize(data []byte) (message, error) {
+	var arr []interface{}
+	if err := codec.NewDecoderBytes(data, newCborHandle()).Decode(&arr); err != nil {
+		return nil, err
+	} else if len(arr) == 0 {
+		return nil, fmt.Errorf("Invalid message")
+	}
+
+	// Non-negative integers decode as uint64, negative ones as int64
+	var msgType messageType
+	switch typ := arr[0].(type) {
+	case uint64:
+		msgType = messageType(typ)
+	case int64:
+		msgType = messageType(typ)
+	default:
+		return nil, fmt.Errorf("Unsupported message format")
+	}
+
+	return apply(msgType, arr)
+}
+
 // jSONSerializer is an implementation of Serializer that handles serializing
 // and deserializing jSON encoded payloads.
 type jSONSerializer struct {
@@ -176,28 +283,31 @@ type jSONSerializer struct {
 
 // Serialize marshals the payload into a message.
 //
-// This method does not handle binary data according to WAMP specifications automatically,
-// but instead uses the default implementation in encoding/json.
-// Use the BinaryData type in your structures if using binary data.
+// []byte anywhere in the arguments is sent as binary data according to WAMP
+// specifications. Use the BinaryData type in your structures if using binary data.
 func (s *jSONSerializer) serialize(msg message) ([]byte, error) {
-	return json.Marshal(toList(msg))
+	return json.Marshal(encodeBinary(toList(msg)))
 }
 
 // Deserialize unmarshals the payload into a message.
 //
-// This method does not handle binary data according to WAMP specifications automatically,
-// but instead uses the default implementation in encoding/json.
-// Use the BinaryData type in your structures if using binary data.
+// Binary data according to WAMP specifications comes back as []byte, whole
+// numbers as int64 (or uint64 if too large) and other numbers as float64.
 func (s *jSONSerializer) deserialize(data []byte) (message, error) {
+	// Numbers are kept as json.Number until we know whether they are whole, so
+	// ids and large integers don't lose precision on their way through float64
 	var arr []interface{}
-	if err := json.Unmarshal(data, &arr); err != nil {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&arr); err != nil {
 		return nil, err
 	} else if len(arr) == 0 {
 		return nil, fmt.Errorf("Invalid message")
 	}
+	decodeJSONValue(arr)
 
 	var msgType messageType
-	if typ, ok := arr[0].(float64); ok {
+	if typ, ok := arr[0].(int64); ok {
 		msgType = messageType(typ)
 	} else {
 		return nil, fmt.Errorf("Unsupported message format")
@@ -208,23 +318,209 @@ func (s *jSONSerializer) deserialize(data []byte) (message, error) {
 // Marshals and unmarshals byte arrays according to WAMP specifications:
 // https://github.com/tavendo/WAMP/blob/master/spec/basic.md#binary-conversion-of-json-strings
 //
-// This type *should* be used in types that will be marshalled as jSON.
+// The jSON serializer takes care of []byte in arguments on its own. This type
+// is for []byte fields of structs that will be marshalled as jSON.
 type BinaryData []byte
 
-func (b BinaryData) marshaljSON() ([]byte, error) {
+func (b BinaryData) MarshalJSON() ([]byte, error) {
 	s := base64.StdEncoding.EncodeToString([]byte(b))
 	return json.Marshal("\x00" + s)
 }
 
-func (b *BinaryData) unmarshaljSON(arr []byte) error {
+func (b *BinaryData) UnmarshalJSON(arr []byte) error {
 	var s string
 	err := json.Unmarshal(arr, &s)
 	if err != nil {
-		return nil
+		return err
 	}
-	if s[0] != '\x00' {
+	if len(s) == 0 || s[0] != '\x00' {
 		return fmt.Errorf("Not a binary string, doesn't start with a NUL: %v", arr)
 	}
 	*b, err = base64.StdEncoding.DecodeString(s[1:])
 	return err
 }
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// Swap every []byte in the value for BinaryData, so it is marshalled the way
+// WAMP says. Typed slices, arrays, maps and structs holding []byte are turned
+// into the lists and dicts encoding/json would have made of them. Nothing is
+// changed in place, and values without []byte are handed back untouched.
+func encodeBinary(v interface{}) interface{} {
+	encoded, _ := encodeBinaryValue(reflect.ValueOf(v))
+	return encoded
+}
+
+// The value with its []byte swapped for BinaryData, and whether there were any
+func encodeBinaryValue(v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+
+	// Types that marshal themselves are left to it, BinaryData included
+	if t := v.Type(); v.Kind() != reflect.Interface && (t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)) {
+		return v.Interface(), false
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return v.Interface(), false
+		}
+		if encoded, ok := encodeBinaryValue(v.Elem()); ok {
+			return encoded, true
+		}
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v.Interface(), false
+		} else if v.Type().Elem().Kind() == reflect.Uint8 {
+			return BinaryData(v.Bytes()), true
+		}
+		return encodeBinaryList(v)
+
+	case reflect.Array:
+		return encodeBinaryList(v)
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String || v.IsNil() {
+			return v.Interface(), false
+		}
+
+		encoded := make(map[string]interface{}, v.Len())
+		changed := false
+		for _, k := range v.MapKeys() {
+			e, ok := encodeBinaryValue(v.MapIndex(k))
+			encoded[k.String()] = e
+			changed = changed || ok
+		}
+		if changed {
+			return encoded, true
+		}
+
+	case reflect.Struct:
+		encoded := make(map[string]interface{})
+		if encodeBinaryStruct(v, encoded) {
+			return encoded, true
+		}
+	}
+
+	return v.Interface(), false
+}
+
+func encodeBinaryList(v reflect.Value) (interface{}, bool) {
+	encoded := make([]interface{}, v.Len())
+	changed := false
+	for i := range encoded {
+		e, ok := encodeBinaryValue(v.Index(i))
+		encoded[i] = e
+		changed = changed || ok
+	}
+
+	if !changed {
+		return v.Interface(), false
+	}
+	return encoded, true
+}
+
+// Fill in the dict encoding/json would make of the struct, going by the json
+// tags on its fields. Fields of embedded structs are promoted unless a field
+// of the outer struct already has their name.
+func encodeBinaryStruct(v reflect.Value, encoded map[string]interface{}) bool {
+	t := v.Type()
+	changed := false
+	var embedded []reflect.Value
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				embedded = append(embedded, fv)
+				continue
+			}
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) {
+			continue
+		}
+
+		e, ok := encodeBinaryValue(fv)
+		encoded[name] = e
+		changed = changed || ok
+	}
+
+	for _, e := range embedded {
+		promoted := make(map[string]interface{})
+		changed = encodeBinaryStruct(e, promoted) || changed
+		for name, fv := range promoted {
+			if _, ok := encoded[name]; !ok {
+				encoded[name] = fv
+			}
+		}
+	}
+
+	return changed
+}
+
+// What encoding/json leaves out for omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Turn every string holding binary data the way WAMP says back into []byte,
+// and every number into its exact value. Decodes lists and dicts in place.
+func decodeJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		return numberValue(v)
+	case string:
+		if len(v) > 0 && v[0] == '\x00' {
+			if b, err := base64.StdEncoding.DecodeString(v[1:]); err == nil {
+				return b
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = decodeJSONValue(e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = decodeJSONValue(e)
+		}
+	}
+	return v
+}
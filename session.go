@@ -1,37 +1,160 @@
 package goriffle
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/exis-io/browrilla"
 )
 
-type authFunc func(map[string]interface{}, map[string]interface{}) (string, map[string]interface{}, error)
-
 type session struct {
 	connection
 	ReceiveTimeout time.Duration
-	Auth           map[string]authFunc
+	Auth           map[string]AuthFunc
 	ReceiveDone    chan bool
-	listeners      map[uint]chan message
-	events         map[uint]*boundEndpoint
+	listeners      map[uint]*listener
+	events         map[uint]*topicBinding
+	subscribing    []*topicBinding
 	procedures     map[uint]*boundEndpoint
+	invocations    map[uint]context.CancelFunc
 	requestCount   uint
 	pdid           string
+
+	// Guards listeners, events, subscribing, procedures, and invocations,
+	// which are touched both by callers and by the Receive loop
+	lock sync.Mutex
+
+	// Reconnect makes Receive redial the node when the connection drops,
+	// rejoin the realm and reissue every subscription and registration.
+	Reconnect bool
+	// Delay before the first reconnect attempt, doubled on every failure.
+	ReconnectMinDelay time.Duration
+	// Upper bound for the delay between reconnect attempts.
+	ReconnectMaxDelay time.Duration
+	// Give up after this many failed attempts in a row. Zero retries forever.
+	ReconnectAttempts int
+
+	dial     func() (connection, error)
+	connLock sync.RWMutex
+	realm    string
+	details  map[string]interface{}
+	leaving  bool
 }
 
 type boundEndpoint struct {
 	endpoint string
 	handler  interface{}
+	options  map[string]interface{}
 }
 
-// Connect to the node with the given URL
+// Connect to the node with the given URL. ws:// and wss:// URLs connect over
+// a websocket, tcp:// and unix:// ones over RawSocket.
 func Start(url string, domain string) (*session, error) {
+	client, err := connect(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client.JoinRealm(domain, nil)
+	return client, nil
+}
+
+// StartWithConfig connects to the node with the given URL, authenticating the
+// way the config says
+func StartWithConfig(url string, domain string, cfg *Config) (*session, error) {
+	client, err := connect(url, cfg)
+	if err != nil {
+		return nil, err
+	}
 
+	if cfg != nil {
+		client.Auth = cfg.Auth
+	}
+
+	if _, err := client.JoinRealm(domain, cfg.details()); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func connect(url string, cfg *Config) (*session, error) {
+	var subprotocols []string
+	if cfg != nil {
+		subprotocols = cfg.Subprotocols
+	}
+
+	conn, err := dialURL(url, subprotocols)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newSession(conn)
+	client.dial = func() (connection, error) {
+		return dialURL(url, subprotocols)
+	}
+	return client, nil
+}
+
+// StartLocal joins a node running in this process over an in-memory pipe
+func StartLocal(n *Node, domain string) (*session, error) {
+	dial := func() (connection, error) {
+		client, server := pipe(nil)
+		go n.Accept(server)
+		return client, nil
+	}
+
+	conn, _ := dial()
+	client := newSession(conn)
+	client.dial = dial
+
+	if _, err := client.JoinRealm(domain, nil); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func newSession(conn connection) *session {
+	return &session{
+		connection:        conn,
+		ReceiveTimeout:    1 * time.Second,
+		ReconnectMinDelay: defaultReconnectMinDelay,
+		ReconnectMaxDelay: defaultReconnectMaxDelay,
+		listeners:         make(map[uint]*listener),
+		events:            make(map[uint]*topicBinding),
+		procedures:        make(map[uint]*boundEndpoint),
+		invocations:       make(map[uint]context.CancelFunc),
+		requestCount:      0,
+	}
+}
+
+// Open a connection to the node. tcp:// and unix:// URLs are dialed with
+// RawSocket, anything else with a websocket. The subprotocols are offered to
+// the node in order; RawSocket can only ask for one, so it takes the first it
+// supports.
+func dialURL(url string, subprotocols []string) (connection, error) {
+	if len(subprotocols) == 0 {
+		subprotocols = defaultSubprotocols
+	}
+
+	switch {
+	case strings.HasPrefix(url, "tcp://"):
+		return dialRawSocket("tcp", strings.TrimPrefix(url, "tcp://"), rawSocketSerialization(subprotocols))
+	case strings.HasPrefix(url, "unix://"):
+		return dialRawSocket("unix", strings.TrimPrefix(url, "unix://"), rawSocketSerialization(subprotocols))
+	}
+	return dialWebsocket(url, subprotocols)
+}
+
+// Open a websocket to the node and start reading from it, speaking whichever
+// of the subprotocols the node picked
+func dialWebsocket(url string, subprotocols []string) (connection, error) {
 	// Part 1: could sub in directly here with "Dial" replacement
-	dialer := websocket.Dialer{Subprotocols: []string{"wamp.2.msgPack"}}
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
 	conn, _, err := dialer.Dial(url, nil)
 
 	if err != nil {
@@ -39,6 +162,19 @@ func Start(url string, domain string) (*session, error) {
 		return nil, err
 	}
 
+	// Nodes that don't say which they picked are assumed to go along with
+	// our first choice
+	protocol := conn.Subprotocol()
+	if protocol == "" {
+		protocol = subprotocols[0]
+	}
+
+	serialization, ok := subprotocolSerialization(protocol)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("node picked unsupported subprotocol: %s", protocol)
+	}
+
 	// ws, err := jssock.New(url)
 
 	// if err != nil {
@@ -52,27 +188,12 @@ func Start(url string, domain string) (*session, error) {
 		conn: conn,
 		// jsws:        ws,
 		messages:    make(chan message, 10),
-		serializer:  new(jSONSerializer),
-		payloadType: websocket.TextMessage,
-	}
-
-	if err != nil {
-		return nil, err
+		serializer:  serialization.serializer(),
+		payloadType: serialization.payloadType(),
 	}
 
 	go connection.run()
-
-	client := &session{
-		connection:     connection,
-		ReceiveTimeout: 1 * time.Second,
-		listeners:      make(map[uint]chan message),
-		events:         make(map[uint]*boundEndpoint),
-		procedures:     make(map[uint]*boundEndpoint),
-		requestCount:   0,
-	}
-
-	client.JoinRealm(domain, nil)
-	return client, nil
+	return connection, nil
 }
 
 // func jsHandle(a *js.Object) {
@@ -85,41 +206,18 @@ func Start(url string, domain string) (*session, error) {
 
 // Receive handles messages from the server until this client disconnects.
 // This function blocks and is most commonly run in a goroutine.
+//
+// If Reconnect is set a dropped connection is redialed and the session resumed
+// before Receive carries on; it only returns once reconnecting gives up.
 func (c *session) Receive() {
-	for msg := range c.connection.Receive() {
-		//fmt.Println("GR: Core MSG: ", msg)
-
-		switch msg := msg.(type) {
-
-		case *event:
-			if event, ok := c.events[msg.Subscription]; ok {
-				go cumin(event.handler, msg.Arguments)
-			} else {
-				log.Println("no handler registered for subscription:", msg.Subscription)
-			}
+	for {
+		for msg := range c.conn().Receive() {
+			c.handle(msg)
+		}
+		c.closeListeners()
 
-		case *invocation:
-			c.handleInvocation(msg)
-
-		case *registered:
-			c.notifyListener(msg, msg.Request)
-		case *subscribed:
-			c.notifyListener(msg, msg.Request)
-		case *unsubscribed:
-			c.notifyListener(msg, msg.Request)
-		case *unregistered:
-			c.notifyListener(msg, msg.Request)
-		case *result:
-			c.notifyListener(msg, msg.Request)
-		case *errorMessage:
-			c.notifyListener(msg, msg.Request)
-
-		case *goodbye:
+		if !c.Reconnect || c.isLeaving() || c.reconnect() != nil {
 			break
-
-		default:
-			log.Println("unhandled message:", msg.messageType(), msg)
-			panic("Unhandled message!")
 		}
 	}
 
@@ -128,48 +226,202 @@ func (c *session) Receive() {
 	}
 }
 
+func (c *session) handle(msg message) {
+	//fmt.Println("GR: Core MSG: ", msg)
+
+	switch msg := msg.(type) {
+
+	case *event:
+		if handlers, ok := c.eventHandlers(msg.Subscription); ok {
+			for _, sub := range handlers {
+				go c.handleEvent(sub, msg)
+			}
+		} else {
+			log.Println("no handler registered for subscription:", msg.Subscription)
+		}
+
+	case *invocation:
+		c.handleInvocation(msg)
+	case *interrupt:
+		c.handleInterrupt(msg)
+
+	case *published:
+		c.notifyListener(msg, msg.Request)
+	case *registered:
+		c.notifyListener(msg, msg.Request)
+	case *subscribed:
+		c.notifyListener(msg, msg.Request)
+	case *unsubscribed:
+		c.notifyListener(msg, msg.Request)
+	case *unregistered:
+		c.notifyListener(msg, msg.Request)
+	case *result:
+		c.notifyListener(msg, msg.Request)
+	case *errorMessage:
+		c.notifyListener(msg, msg.Request)
+
+	case *goodbye:
+		break
+
+	default:
+		log.Println("unhandled message:", msg.messageType(), msg)
+	}
+}
+
+// The connection currently in use. It is replaced when the session reconnects.
+func (c *session) conn() connection {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.connection
+}
+
+// Send a message over the current connection
+func (c *session) Send(msg message) error {
+	return c.conn().Send(msg)
+}
+
+func (c *session) isLeaving() bool {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.leaving
+}
+
 /////////////////////////////////////////////
 // Handler methods
 /////////////////////////////////////////////
 
-// Subscribe registers the EventHandler to be called for every message in the provided topic.
+// Subscribe registers the EventHandler to be called for every message in the
+// provided topic. Use SubscribeWithOptions to get a handle that can be
+// unsubscribed on its own.
 func (c *session) Subscribe(topic string, fn interface{}) error {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.SubscribeContext(ctx, topic, fn)
+}
+
+// SubscribeContext is Subscribe, but stops waiting on the node once ctx is done.
+func (c *session) SubscribeContext(ctx context.Context, topic string, fn interface{}) error {
+	_, err := c.subscribe(ctx, topic, make(map[string]interface{}), fn)
+	return err
+}
+
+// SubscribeWithOptions subscribes to a topic the way the options say, such as
+// to every topic matching a pattern. Options may be nil.
+func (c *session) SubscribeWithOptions(topic string, opts *SubscribeOptions, fn interface{}) (*Subscription, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.SubscribeWithOptionsContext(ctx, topic, opts, fn)
+}
+
+// SubscribeWithOptionsContext is SubscribeWithOptions, but stops waiting on the node once ctx is done.
+func (c *session) SubscribeWithOptionsContext(ctx context.Context, topic string, opts *SubscribeOptions, fn interface{}) (*Subscription, error) {
+	return c.subscribe(ctx, topic, opts.options(), fn)
+}
+
+// Add a handler to the node subscription to the topic, subscribing first if
+// there is none yet
+func (c *session) subscribe(ctx context.Context, topic string, options map[string]interface{}, fn interface{}) (*Subscription, error) {
+	s := &Subscription{Topic: topic, handler: fn, session: c}
+
+	c.lock.Lock()
+	if _, b, ok := topicBindingFor(c.events, topic, options); ok {
+		s.topic = b
+		b.handlers = append(b.handlers, s)
+		c.lock.Unlock()
+		return s, nil
+	}
+
+	// Someone else is already subscribing to the topic, so wait on their
+	// subscribe rather than sending another
+	if b, ok := pendingTopicFor(c.subscribing, topic, options); ok {
+		s.topic = b
+		b.handlers = append(b.handlers, s)
+		c.lock.Unlock()
+
+		select {
+		case <-b.subscribed:
+		case <-ctx.Done():
+			c.lock.Lock()
+			s.topic.remove(s)
+			c.lock.Unlock()
+			return nil, contextError(ctx)
+		}
+
+		if b.err != nil {
+			return nil, b.err
+		}
+		return s, nil
+	}
+
+	s.topic = &topicBinding{endpoint: topic, options: options, handlers: []*Subscription{s}, subscribed: make(chan struct{})}
+	c.subscribing = append(c.subscribing, s.topic)
+	c.lock.Unlock()
+
+	err := c.subscribeTopic(ctx, s.topic)
+	c.finishSubscribing(s.topic, err)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ask the node for a subscription to the binding's topic and send its events
+// to the binding's handlers
+func (c *session) subscribeTopic(ctx context.Context, b *topicBinding) error {
 	id := newID()
 	c.registerListener(id)
 
 	sub := &subscribe{
 		Request: id,
-		Options: make(map[string]interface{}),
-		Domain:  topic,
+		Options: b.options,
+		Domain:  b.endpoint,
 	}
 
 	if err := c.Send(sub); err != nil {
+		c.removeListener(id)
 		return err
 	}
 
 	// wait to receive sUBSCRIBED message
-	msg, err := c.waitOnListener(id)
+	msg, err := c.waitOnListener(ctx, id)
 	if err != nil {
 		return err
 	} else if e, ok := msg.(*errorMessage); ok {
-		return fmt.Errorf("error subscribing to topic '%v': %v", topic, e.Error)
+		return fmt.Errorf("error subscribing to topic '%v': %v", b.endpoint, e.Error)
 	} else if subscribed, ok := msg.(*subscribed); !ok {
 		return fmt.Errorf(formatUnexpectedMessage(msg, sUBSCRIBED))
 	} else {
-		// register the event handler with this subscription
-		c.events[subscribed.Subscription] = &boundEndpoint{topic, fn}
+		// register the event handlers with this subscription
+		c.bindTopic(subscribed.Subscription, b)
 	}
 	return nil
 }
 
-// Unsubscribe removes the registered EventHandler from the topic.
+// Unsubscribe removes every EventHandler subscribed to the topic.
 func (c *session) Unsubscribe(topic string) error {
-	subscriptionID, _, ok := bindingForEndpoint(c.events, topic)
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.UnsubscribeContext(ctx, topic)
+}
+
+// UnsubscribeContext is Unsubscribe, but stops waiting on the node once ctx is done.
+func (c *session) UnsubscribeContext(ctx context.Context, topic string) error {
+	c.lock.Lock()
+	subscriptionID, _, ok := topicBindingFor(c.events, topic, nil)
+	if ok {
+		delete(c.events, subscriptionID)
+	}
+	c.lock.Unlock()
 
 	if !ok {
 		return fmt.Errorf("Domain %s is not registered with this client.", topic)
 	}
 
+	return c.unsubscribe(ctx, topic, subscriptionID)
+}
+
+// Drop the node subscription with the given id
+func (c *session) unsubscribe(ctx context.Context, topic string, subscriptionID uint) error {
 	id := newID()
 	c.registerListener(id)
 
@@ -179,11 +431,12 @@ func (c *session) Unsubscribe(topic string) error {
 	}
 
 	if err := c.Send(sub); err != nil {
+		c.removeListener(id)
 		return err
 	}
 
 	// wait to receive uNSUBSCRIBED message
-	msg, err := c.waitOnListener(id)
+	msg, err := c.waitOnListener(ctx, id)
 	if err != nil {
 		return err
 	} else if e, ok := msg.(*errorMessage); ok {
@@ -192,11 +445,18 @@ func (c *session) Unsubscribe(topic string) error {
 		return fmt.Errorf(formatUnexpectedMessage(msg, uNSUBSCRIBED))
 	}
 
-	delete(c.events, subscriptionID)
 	return nil
 }
 
+// Register makes fn callable by other peers under the given procedure.
 func (c *session) Register(procedure string, fn interface{}, options map[string]interface{}) error {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.RegisterContext(ctx, procedure, fn, options)
+}
+
+// RegisterContext is Register, but stops waiting on the node once ctx is done.
+func (c *session) RegisterContext(ctx context.Context, procedure string, fn interface{}, options map[string]interface{}) error {
 	id := newID()
 	c.registerListener(id)
 
@@ -207,11 +467,12 @@ func (c *session) Register(procedure string, fn interface{}, options map[string]
 	}
 
 	if err := c.Send(register); err != nil {
+		c.removeListener(id)
 		return err
 	}
 
 	// wait to receive rEGISTERED message
-	msg, err := c.waitOnListener(id)
+	msg, err := c.waitOnListener(ctx, id)
 	if err != nil {
 		return err
 	} else if e, ok := msg.(*errorMessage); ok {
@@ -220,14 +481,35 @@ func (c *session) Register(procedure string, fn interface{}, options map[string]
 		return fmt.Errorf(formatUnexpectedMessage(msg, rEGISTERED))
 	} else {
 		// register the event handler with this registration
-		c.procedures[registered.Registration] = &boundEndpoint{procedure, fn}
+		c.bind(c.procedures, registered.Registration, &boundEndpoint{procedure, fn, options})
 	}
 	return nil
 }
 
+// RegisterWithOptions makes fn callable by other peers under the given
+// procedure the way the options say, such as sharing it with other callees.
+// Options may be nil.
+func (c *session) RegisterWithOptions(procedure string, opts *RegisterOptions, fn interface{}) error {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.RegisterWithOptionsContext(ctx, procedure, opts, fn)
+}
+
+// RegisterWithOptionsContext is RegisterWithOptions, but stops waiting on the node once ctx is done.
+func (c *session) RegisterWithOptionsContext(ctx context.Context, procedure string, opts *RegisterOptions, fn interface{}) error {
+	return c.RegisterContext(ctx, procedure, fn, opts.options())
+}
+
 // Unregister removes a procedure with the Node
 func (c *session) Unregister(procedure string) error {
-	procedureID, _, ok := bindingForEndpoint(c.procedures, procedure)
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.UnregisterContext(ctx, procedure)
+}
+
+// UnregisterContext is Unregister, but stops waiting on the node once ctx is done.
+func (c *session) UnregisterContext(ctx context.Context, procedure string) error {
+	procedureID, _, ok := c.bindingFor(c.procedures, procedure)
 
 	if !ok {
 		return fmt.Errorf("Domain %s is not registered with this client.", procedure)
@@ -242,11 +524,12 @@ func (c *session) Unregister(procedure string) error {
 	}
 
 	if err := c.Send(unregister); err != nil {
+		c.removeListener(id)
 		return err
 	}
 
 	// wait to receive uNREGISTERED message
-	msg, err := c.waitOnListener(id)
+	msg, err := c.waitOnListener(ctx, id)
 	if err != nil {
 		return err
 	} else if e, ok := msg.(*errorMessage); ok {
@@ -256,81 +539,224 @@ func (c *session) Unregister(procedure string) error {
 	}
 
 	// register the event handler with this unregistration
-	delete(c.procedures, procedureID)
+	c.unbind(c.procedures, procedureID)
 	return nil
 }
 
-// Publish publishes an eVENT to all subscribed peers.
+// Publish publishes an eVENT to all subscribed peers. A trailing Kwargs
+// argument is published as keyword arguments.
 func (c *session) Publish(endpoint string, args ...interface{}) error {
-	return c.Send(&publish{
-		Request:   newID(),
-		Options:   make(map[string]interface{}),
-		Domain:    endpoint,
-		Arguments: args,
-	})
+	_, err := c.PublishWithOptionsContext(context.Background(), endpoint, nil, args...)
+	return err
 }
 
-// Call calls a procedure given a URI.
+// PublishAck is Publish, but waits for the node to acknowledge the
+// publication and returns its id.
+func (c *session) PublishAck(endpoint string, args ...interface{}) (uint, error) {
+	return c.PublishWithOptions(endpoint, &PublishOptions{Acknowledge: true}, args...)
+}
+
+// PublishAckContext is PublishAck, but stops waiting on the node once ctx is done.
+func (c *session) PublishAckContext(ctx context.Context, endpoint string, args ...interface{}) (uint, error) {
+	return c.PublishWithOptionsContext(ctx, endpoint, &PublishOptions{Acknowledge: true}, args...)
+}
+
+// PublishWithOptions is Publish with control over who receives the event. If
+// the options ask for an acknowledgement it waits for one and returns the
+// publication id, otherwise the id is always 0.
+func (c *session) PublishWithOptions(endpoint string, opts *PublishOptions, args ...interface{}) (uint, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.PublishWithOptionsContext(ctx, endpoint, opts, args...)
+}
+
+// PublishWithOptionsContext is PublishWithOptions, but stops waiting on the node once ctx is done.
+func (c *session) PublishWithOptionsContext(ctx context.Context, endpoint string, opts *PublishOptions, args ...interface{}) (uint, error) {
+	id := newID()
+	args, kwargs := splitKwargs(args)
+
+	pub := &publish{
+		Request:     id,
+		Options:     opts.options(),
+		Domain:      endpoint,
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	}
+
+	if opts == nil || !opts.Acknowledge {
+		return 0, c.Send(pub)
+	}
+
+	c.registerListener(id)
+	if err := c.Send(pub); err != nil {
+		c.removeListener(id)
+		return 0, err
+	}
+
+	// wait to receive pUBLISHED message
+	msg, err := c.waitOnListener(ctx, id)
+	if err != nil {
+		return 0, err
+	} else if e, ok := msg.(*errorMessage); ok {
+		return 0, fmt.Errorf("error publishing to topic '%v': %v", endpoint, e.Error)
+	} else if published, ok := msg.(*published); !ok {
+		return 0, fmt.Errorf(formatUnexpectedMessage(msg, pUBLISHED))
+	} else {
+		return published.Publication, nil
+	}
+}
+
+// Call calls a procedure given a URI. A trailing Kwargs argument is sent as
+// keyword arguments, and any keyword arguments in the result come back as a
+// Kwargs at the end of the returned list.
 func (c *session) Call(procedure string, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.CallContext(ctx, procedure, args...)
+}
+
+// CallContext is Call, but gives up on the result once ctx is done. A call
+// abandoned this way is cancelled with the node.
+func (c *session) CallContext(ctx context.Context, procedure string, args ...interface{}) ([]interface{}, error) {
+	results, err := c.CallResultsContext(ctx, procedure, args...)
+	if err != nil {
+		return nil, err
+	}
+	return joinKwargs(results.Args, results.Kwargs), nil
+}
+
+// CallResults is Call, but hands back the results as Results so they can be
+// decoded into typed values.
+func (c *session) CallResults(procedure string, args ...interface{}) (*Results, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.CallResultsContext(ctx, procedure, args...)
+}
+
+// CallResultsContext is CallResults, but gives up on the result once ctx is done.
+func (c *session) CallResultsContext(ctx context.Context, procedure string, args ...interface{}) (*Results, error) {
+	return c.call(ctx, procedure, nil, args)
+}
+
+// CallProgress is Call for procedures that stream progressive results. The
+// progress handler is called with each partial result, in order, before
+// CallProgress returns the final one.
+func (c *session) CallProgress(procedure string, progress interface{}, args ...interface{}) ([]interface{}, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.CallProgressContext(ctx, procedure, progress, args...)
+}
+
+// CallProgressContext is CallProgress, but gives up on the result once ctx is done.
+func (c *session) CallProgressContext(ctx context.Context, procedure string, progress interface{}, args ...interface{}) ([]interface{}, error) {
+	results, err := c.call(ctx, procedure, progress, args)
+	if err != nil {
+		return nil, err
+	}
+	return joinKwargs(results.Args, results.Kwargs), nil
+}
+
+// Call a procedure and wait for its result. If progress is not nil the callee
+// is asked for progressive results, which are handed to progress as they come.
+func (c *session) call(ctx context.Context, procedure string, progress interface{}, args []interface{}) (*Results, error) {
 	id := newID()
 	c.registerListener(id)
+	defer c.removeListener(id)
+
+	args, kwargs := splitKwargs(args)
 
 	call := &call{
-		Request:   id,
-		Domain:    procedure,
-		Options:   make(map[string]interface{}),
-		Arguments: args,
+		Request:     id,
+		Domain:      procedure,
+		Options:     make(map[string]interface{}),
+		Arguments:   args,
+		ArgumentsKw: kwargs,
+	}
+
+	if progress != nil {
+		call.Options["receive_progress"] = true
+	}
+
+	// Let the callee know how long we'll wait
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout := time.Until(deadline).Milliseconds(); timeout > 0 {
+			call.Options["timeout"] = timeout
+		}
 	}
 
 	if err := c.Send(call); err != nil {
 		return nil, err
 	}
 
-	// wait to receive rESULT message
-	msg, err := c.waitOnListener(id)
-	if err != nil {
-		return nil, err
-	} else if e, ok := msg.(*errorMessage); ok {
-		return nil, fmt.Errorf("error calling procedure '%v': %v", procedure, e.Error)
-	} else if result, ok := msg.(*result); !ok {
-		return nil, fmt.Errorf(formatUnexpectedMessage(msg, rESULT))
-	} else {
-		return result.Arguments, nil
+	for {
+		// wait to receive rESULT message
+		msg, err := c.nextMessage(ctx, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				c.cancelCall(ctx, id)
+			}
+			return nil, err
+		} else if e, ok := msg.(*errorMessage); ok {
+			return nil, &CallError{Procedure: procedure, URI: e.Error, Args: e.Arguments, Kwargs: e.ArgumentsKw}
+		} else if result, ok := msg.(*result); !ok {
+			return nil, fmt.Errorf(formatUnexpectedMessage(msg, rESULT))
+		} else if isProgress(result.Details) && progress != nil {
+			if _, err := cumin(progress, result.Arguments, result.ArgumentsKw); err != nil {
+				log.Println("error handling progress for", procedure+":", err)
+			}
+		} else {
+			return &Results{Args: result.Arguments, Kwargs: result.ArgumentsKw}, nil
+		}
 	}
 }
 
+func isProgress(details map[string]interface{}) bool {
+	progress, _ := details["progress"].(bool)
+	return progress
+}
+
 func (c *session) Leave() error {
+	c.connLock.Lock()
+	c.leaving = true
+	c.connLock.Unlock()
+
 	if err := c.Send(goodbyeSession); err != nil {
 		return fmt.Errorf("error leaving realm: %v", err)
 	}
 
-	if err := c.connection.Close(); err != nil {
+	if err := c.conn().Close(); err != nil {
 		return fmt.Errorf("error closing client connection: %v", err)
 	}
 
 	return nil
 }
 
+func (c *session) handleEvent(sub *Subscription, msg *event) {
+	if _, err := cumin(sub.handler, msg.Arguments, msg.ArgumentsKw, newEventDetails(sub.Topic, msg)); err != nil {
+		log.Println("error handling event for", sub.Topic+":", err)
+	}
+}
+
 func (c *session) handleInvocation(msg *invocation) {
-	if proc, ok := c.procedures[msg.Registration]; ok {
+	if proc, ok := c.binding(c.procedures, msg.Registration); ok {
+		ctx := c.startInvocation(msg.Request)
+
 		go func() {
-			result, err := cumin(proc.handler, msg.Arguments)
+			defer c.finishInvocation(msg.Request)
+
+			result, err := cumin(proc.handler, msg.Arguments, msg.ArgumentsKw, c.progressFor(msg), ctx, newInvocationDetails(proc.endpoint, msg))
+			result, kwargs := splitKwargs(result)
 			var tosend message
 
 			tosend = &yield{
-				Request:   msg.Request,
-				Options:   make(map[string]interface{}),
-				Arguments: result,
+				Request:     msg.Request,
+				Options:     make(map[string]interface{}),
+				Arguments:   result,
+				ArgumentsKw: kwargs,
 			}
 
 			if err != nil {
-				tosend = &errorMessage{
-					Type:      iNVOCATION,
-					Request:   msg.Request,
-					Details:   make(map[string]interface{}),
-					Arguments: result,
-					Error:     err.Error(),
-				}
+				tosend = invocationError(msg.Request, err)
 			}
 
 			if err := c.Send(tosend); err != nil {
@@ -341,41 +767,94 @@ func (c *session) handleInvocation(msg *invocation) {
 		//log.Println("no handler registered for registration:", msg.Registration)
 
 		if err := c.Send(&errorMessage{
-			Type:    iNVOCATION,
-			Request: msg.Request,
-			Details: make(map[string]interface{}),
-			Error:   fmt.Sprintf("no handler for registration: %v", msg.Registration),
+			Type:      iNVOCATION,
+			Request:   msg.Request,
+			Details:   make(map[string]interface{}),
+			Error:     ErrNoSuchRegistration,
+			Arguments: []interface{}{msg.Registration},
 		}); err != nil {
 			log.Println("error sending message:", err)
 		}
 	}
 }
 
+// The Progress a handler uses to stream results back for the given invocation.
+// If the caller didn't ask for progressive results they are dropped.
+func (c *session) progressFor(msg *invocation) Progress {
+	wanted, _ := msg.Details["receive_progress"].(bool)
+
+	return func(args ...interface{}) error {
+		if !wanted {
+			return nil
+		}
+
+		args, kwargs := splitKwargs(args)
+		return c.Send(&yield{
+			Request:     msg.Request,
+			Options:     map[string]interface{}{"progress": true},
+			Arguments:   args,
+			ArgumentsKw: kwargs,
+		})
+	}
+}
+
+// Build the error reply to an invocation whose handler failed. Handlers that
+// gave up because they were interrupted report ErrCanceled, and any other
+// error that isn't an *Error is reported as ErrRuntimeError.
+func invocationError(request uint, err error) *errorMessage {
+	var e *Error
+	if errors.Is(err, context.Canceled) {
+		e = NewError(ErrCanceled)
+	} else if !errors.As(err, &e) {
+		e = NewError(ErrRuntimeError, err.Error())
+	}
+
+	return &errorMessage{
+		Type:        iNVOCATION,
+		Request:     request,
+		Details:     make(map[string]interface{}),
+		Error:       e.URI,
+		Arguments:   e.Args,
+		ArgumentsKw: e.Kwargs,
+	}
+}
+
 /////////////////////////////////////////////
 // Misc
 /////////////////////////////////////////////
 
-// JoinRealm joins a WAMP realm, but does not handle challenge/response authentication.
+// JoinRealm joins a WAMP realm, handling challenge/response authentication if
+// any Auth handlers are set.
 func (c *session) JoinRealm(realm string, details map[string]interface{}) (map[string]interface{}, error) {
+	ctx, cancel := c.timeoutContext()
+	defer cancel()
+	return c.JoinRealmContext(ctx, realm, details)
+}
+
+// JoinRealmContext is JoinRealm, but stops waiting on the node once ctx is done.
+func (c *session) JoinRealmContext(ctx context.Context, realm string, details map[string]interface{}) (map[string]interface{}, error) {
 	if details == nil {
 		details = map[string]interface{}{}
 	}
 
+	// Remember how we joined so a reconnect can do it again
+	c.realm, c.details = realm, details
+
 	if c.Auth != nil && len(c.Auth) > 0 {
-		return c.joinRealmCRA(realm, details)
+		return c.joinRealmCRA(ctx, realm, details)
 	}
 
 	if err := c.Send(&hello{Realm: realm, Details: details}); err != nil {
-		c.connection.Close()
+		c.conn().Close()
 		return nil, err
 	}
 
-	if msg, err := getMessageTimeout(c.connection, c.ReceiveTimeout); err != nil {
-		c.connection.Close()
+	if msg, err := getMessageContext(ctx, c.conn()); err != nil {
+		c.conn().Close()
 		return nil, err
 	} else if welcome, ok := msg.(*welcome); !ok {
 		c.Send(abortUnexpectedMsg)
-		c.connection.Close()
+		c.conn().Close()
 		return nil, fmt.Errorf(formatUnexpectedMessage(msg, wELCOME))
 	} else {
 		//go c.Receive()
@@ -384,44 +863,46 @@ func (c *session) JoinRealm(realm string, details map[string]interface{}) (map[s
 }
 
 // joinRealmCRA joins a WAMP realm and handles challenge/response authentication.
-func (c *session) joinRealmCRA(realm string, details map[string]interface{}) (map[string]interface{}, error) {
+func (c *session) joinRealmCRA(ctx context.Context, realm string, details map[string]interface{}) (map[string]interface{}, error) {
 	authmethods := []interface{}{}
 	for m := range c.Auth {
 		authmethods = append(authmethods, m)
 	}
 	details["authmethods"] = authmethods
 	if err := c.Send(&hello{Realm: realm, Details: details}); err != nil {
-		c.connection.Close()
+		c.conn().Close()
 		return nil, err
 	}
-	if msg, err := getMessageTimeout(c.connection, c.ReceiveTimeout); err != nil {
-		c.connection.Close()
+	if msg, err := getMessageContext(ctx, c.conn()); err != nil {
+		c.conn().Close()
 		return nil, err
+	} else if welcome, ok := msg.(*welcome); ok {
+		// The node let us in without asking
+		return welcome.Details, nil
 	} else if challenge, ok := msg.(*challenge); !ok {
 		c.Send(abortUnexpectedMsg)
-		c.connection.Close()
+		c.conn().Close()
 		return nil, fmt.Errorf(formatUnexpectedMessage(msg, cHALLENGE))
 	} else if authFunc, ok := c.Auth[challenge.AuthMethod]; !ok {
 		c.Send(abortNoAuthHandler)
-		c.connection.Close()
+		c.conn().Close()
 		return nil, fmt.Errorf("no auth handler for method: %s", challenge.AuthMethod)
 	} else if signature, authDetails, err := authFunc(details, challenge.Extra); err != nil {
 		c.Send(abortAuthFailure)
-		c.connection.Close()
+		c.conn().Close()
 		return nil, err
 	} else if err := c.Send(&authenticate{Signature: signature, Extra: authDetails}); err != nil {
-		c.connection.Close()
+		c.conn().Close()
 		return nil, err
 	}
-	if msg, err := getMessageTimeout(c.connection, c.ReceiveTimeout); err != nil {
-		c.connection.Close()
+	if msg, err := getMessageContext(ctx, c.conn()); err != nil {
+		c.conn().Close()
 		return nil, err
 	} else if welcome, ok := msg.(*welcome); !ok {
 		c.Send(abortUnexpectedMsg)
-		c.connection.Close()
+		c.conn().Close()
 		return nil, fmt.Errorf(formatUnexpectedMessage(msg, wELCOME))
 	} else {
-		go c.Receive()
 		return welcome.Details, nil
 	}
 }
@@ -435,3 +916,43 @@ func bindingForEndpoint(bindings map[uint]*boundEndpoint, endpoint string) (uint
 
 	return 0, nil, false
 }
+
+// Look up the handler bound to a subscription or registration id
+func (c *session) binding(bindings map[uint]*boundEndpoint, id uint) (*boundEndpoint, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, ok := bindings[id]
+	return b, ok
+}
+
+// Locked version of bindingForEndpoint
+func (c *session) bindingFor(bindings map[uint]*boundEndpoint, endpoint string) (uint, *boundEndpoint, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return bindingForEndpoint(bindings, endpoint)
+}
+
+func (c *session) bind(bindings map[uint]*boundEndpoint, id uint, b *boundEndpoint) {
+	c.lock.Lock()
+	bindings[id] = b
+	c.lock.Unlock()
+}
+
+func (c *session) unbind(bindings map[uint]*boundEndpoint, id uint) {
+	c.lock.Lock()
+	delete(bindings, id)
+	c.lock.Unlock()
+}
+
+// Empty out the given bindings, returning what they held
+func (c *session) takeBindings(bindings map[uint]*boundEndpoint) map[uint]*boundEndpoint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	taken := make(map[uint]*boundEndpoint, len(bindings))
+	for id, b := range bindings {
+		taken[id] = b
+		delete(bindings, id)
+	}
+	return taken
+}
@@ -0,0 +1,268 @@
+package goriffle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCallContext(t *testing.T) {
+	Convey("Calls made with a context", t, func() {
+		conn := newTestConnection()
+		s := newSession(conn)
+		go s.Receive()
+
+		Convey("Are cancelled with the node when the context is cancelled", func() {
+			ctx, stop := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+
+			go func() {
+				_, err := s.CallContext(ctx, "xs.test/slow")
+				done <- err
+			}()
+
+			c, ok := (<-conn.out).(*call)
+			So(ok, ShouldBeTrue)
+			stop()
+
+			So(<-done, ShouldEqual, context.Canceled)
+			m, ok := (<-conn.out).(*cancel)
+			So(ok, ShouldBeTrue)
+			So(m.Request, ShouldEqual, c.Request)
+		})
+
+		Convey("Report an expired deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+
+			_, err := s.CallContext(ctx, "xs.test/slow")
+			So(errors.Is(err, context.DeadlineExceeded), ShouldBeTrue)
+		})
+
+		Convey("Give up when the connection closes", func() {
+			done := make(chan error, 1)
+			go func() {
+				_, err := s.CallContext(context.Background(), "xs.test/slow")
+				done <- err
+			}()
+
+			_, ok := (<-conn.out).(*call)
+			So(ok, ShouldBeTrue)
+			conn.Close()
+
+			select {
+			case err := <-done:
+				So(errors.Is(err, ErrConnectionClosed), ShouldBeTrue)
+			case <-time.After(time.Second):
+				So("gave up", ShouldEqual, "still waiting")
+			}
+		})
+
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
+
+func TestHandlerIsolation(t *testing.T) {
+	Convey("A session with misbehaving handlers", t, func() {
+		conn := newTestConnection()
+		s := newSession(conn)
+		go s.Receive()
+
+		Convey("Answers invocations that panic with a runtime error", func() {
+			s.bind(s.procedures, 1, &boundEndpoint{"xs.test/panic", func() { panic("oh no") }, nil})
+			conn.in <- &invocation{Request: 2, Registration: 1, Details: map[string]interface{}{}}
+
+			e, ok := (<-conn.out).(*errorMessage)
+			So(ok, ShouldBeTrue)
+			So(e.Request, ShouldEqual, 2)
+			So(e.Error, ShouldEqual, ErrRuntimeError)
+		})
+
+		Convey("Answers invocations for unknown registrations with an error URI", func() {
+			conn.in <- &invocation{Request: 2, Registration: 9, Details: map[string]interface{}{}}
+
+			e, ok := (<-conn.out).(*errorMessage)
+			So(ok, ShouldBeTrue)
+			So(e.Request, ShouldEqual, 2)
+			So(e.Error, ShouldEqual, ErrNoSuchRegistration)
+			So(e.Arguments, ShouldResemble, []interface{}{uint(9)})
+		})
+
+		Convey("Keeps going after an event handler panics", func() {
+			done := make(chan bool, 1)
+			handler := func(ok bool) {
+				if !ok {
+					panic("oh no")
+				}
+				done <- ok
+			}
+			s.bindTopic(1, &topicBinding{endpoint: "xs.test/panic", handlers: []*Subscription{{Topic: "xs.test/panic", handler: handler, session: s}}})
+
+			conn.in <- &event{Subscription: 1, Details: map[string]interface{}{}, Arguments: []interface{}{false}}
+			conn.in <- &event{Subscription: 1, Details: map[string]interface{}{}, Arguments: []interface{}{true}}
+			So(<-done, ShouldBeTrue)
+		})
+
+		Convey("Ignores messages it doesn't understand", func() {
+			conn.in <- &heartbeat{}
+			conn.in <- &hello{Realm: "xs.test", Details: map[string]interface{}{}}
+			go echoNode(conn)
+
+			_, err := s.Call("xs.test/echo")
+			So(err, ShouldBeNil)
+		})
+
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	Convey("A session shared by many goroutines", t, func() {
+		conn := newTestConnection()
+		go echoNode(conn)
+
+		s := newSession(conn)
+		go s.Receive()
+
+		Convey("Routes every reply to the right caller", func() {
+			const callers = 300
+			errs := make(chan error, callers)
+			var wg sync.WaitGroup
+
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- exercise(s, i)
+				}(i)
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			So(len(s.listeners), ShouldEqual, 0)
+			So(len(s.events), ShouldEqual, 0)
+			So(len(s.procedures), ShouldEqual, 0)
+		})
+
+		Convey("Cleans up listeners that time out", func() {
+			s.ReceiveTimeout = time.Millisecond
+			var wg sync.WaitGroup
+
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.Call("xs.test/slow")
+				}()
+			}
+
+			wg.Wait()
+			s.lock.Lock()
+			So(len(s.listeners), ShouldEqual, 0)
+			s.lock.Unlock()
+		})
+	})
+}
+
+func TestConcurrentSubscribe(t *testing.T) {
+	Convey("Handlers subscribing to a topic at the same time", t, func() {
+		conn := newTestConnection()
+		s := newSession(conn)
+		go s.Receive()
+
+		const handlers = 20
+		errs := make(chan error, handlers)
+		for i := 0; i < handlers; i++ {
+			go func() {
+				_, err := s.SubscribeWithOptions("xs.test/shared", nil, func() {})
+				errs <- err
+			}()
+		}
+
+		// Hold the reply back until every handler has had a chance to subscribe
+		sub := (<-conn.out).(*subscribe)
+		time.Sleep(20 * time.Millisecond)
+		conn.in <- &subscribed{Request: sub.Request, Subscription: 1}
+
+		for i := 0; i < handlers; i++ {
+			So(<-errs, ShouldBeNil)
+		}
+
+		Convey("Share a single node subscription", func() {
+			So(len(conn.out), ShouldEqual, 0)
+
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			So(len(s.subscribing), ShouldEqual, 0)
+			So(len(s.events), ShouldEqual, 1)
+			So(len(s.events[1].handlers), ShouldEqual, handlers)
+		})
+
+		Reset(func() {
+			conn.Close()
+		})
+	})
+}
+
+// Run one of each request type against the session
+func exercise(s *session, i int) error {
+	topic := fmt.Sprintf("xs.test/topic%d", i)
+	procedure := fmt.Sprintf("xs.test/proc%d", i)
+
+	if err := s.Subscribe(topic, func() {}); err != nil {
+		return err
+	}
+	if err := s.Register(procedure, func() {}, nil); err != nil {
+		return err
+	}
+
+	if ret, err := s.Call("xs.test/echo", i); err != nil {
+		return err
+	} else if len(ret) != 1 || ret[0] != i {
+		return fmt.Errorf("call %d got the wrong result: %v", i, ret)
+	}
+
+	if err := s.Unsubscribe(topic); err != nil {
+		return err
+	}
+	return s.Unregister(procedure)
+}
+
+// Answers every request on the connection like a well behaved node would.
+// Calls are echoed back, except to xs.test/slow which never returns.
+func echoNode(c *testConnection) {
+	for msg := range c.out {
+		switch msg := msg.(type) {
+		case *hello:
+			c.in <- &welcome{Id: newID(), Details: map[string]interface{}{}}
+		case *subscribe:
+			c.in <- &subscribed{Request: msg.Request, Subscription: newID()}
+		case *unsubscribe:
+			c.in <- &unsubscribed{Request: msg.Request}
+		case *register:
+			c.in <- &registered{Request: msg.Request, Registration: newID()}
+		case *unregister:
+			c.in <- &unregistered{Request: msg.Request}
+		case *call:
+			if msg.Domain != "xs.test/slow" {
+				c.in <- &result{Request: msg.Request, Details: map[string]interface{}{}, Arguments: msg.Arguments}
+			}
+		}
+	}
+}
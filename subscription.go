@@ -0,0 +1,173 @@
+package goriffle
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Subscription is one handler's subscription to a topic. Handlers subscribed
+// to the same topic with the same options share a single subscription on the
+// node, which is only dropped once the last of them unsubscribes.
+type Subscription struct {
+	Topic string
+
+	handler interface{}
+	session *session
+	// The node subscription this handler hangs off. Guarded by session.lock.
+	topic *topicBinding
+}
+
+// A subscription on the node and the local handlers its events go to
+type topicBinding struct {
+	endpoint string
+	options  map[string]interface{}
+	handlers []*Subscription
+
+	// Closed once the node has answered the subscribe, with err set if it
+	// refused. Handlers subscribing meanwhile wait on it instead of sending a
+	// subscribe of their own.
+	subscribed chan struct{}
+	err        error
+}
+
+// Unsubscribe stops events going to this handler
+func (s *Subscription) Unsubscribe() error {
+	ctx, cancel := s.session.timeoutContext()
+	defer cancel()
+	return s.UnsubscribeContext(ctx)
+}
+
+// UnsubscribeContext is Unsubscribe, but stops waiting on the node once ctx is done.
+func (s *Subscription) UnsubscribeContext(ctx context.Context) error {
+	c := s.session
+
+	c.lock.Lock()
+	id, ok := topicBindingID(c.events, s.topic)
+	if ok && !s.topic.remove(s) {
+		ok = false
+	}
+
+	last := ok && len(s.topic.handlers) == 0
+	if last {
+		delete(c.events, id)
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		return fmt.Errorf("Domain %s is not subscribed to by this handler.", s.Topic)
+	} else if !last {
+		return nil
+	}
+
+	return c.unsubscribe(ctx, s.Topic, id)
+}
+
+// Drop a handler, returning false if it wasn't there
+func (b *topicBinding) remove(s *Subscription) bool {
+	for i, h := range b.handlers {
+		if h == s {
+			b.handlers = append(b.handlers[:i:i], b.handlers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func topicBindingID(bindings map[uint]*topicBinding, b *topicBinding) (uint, bool) {
+	for id, t := range bindings {
+		if t == b {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// Find the node subscription to a topic. With options, only one subscribed
+// with the very same options counts.
+func topicBindingFor(bindings map[uint]*topicBinding, endpoint string, options map[string]interface{}) (uint, *topicBinding, bool) {
+	for id, t := range bindings {
+		if t.endpoint == endpoint && (options == nil || reflect.DeepEqual(t.options, options)) {
+			return id, t, true
+		}
+	}
+	return 0, nil, false
+}
+
+// Find a subscribe to a topic still waiting on the node, sent with the very
+// same options
+func pendingTopicFor(pending []*topicBinding, endpoint string, options map[string]interface{}) (*topicBinding, bool) {
+	for _, t := range pending {
+		if t.endpoint == endpoint && reflect.DeepEqual(t.options, options) {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// The node answered the subscribe for the binding, so let anyone waiting on
+// it know how it went
+func (c *session) finishSubscribing(b *topicBinding, err error) {
+	c.lock.Lock()
+	for i, t := range c.subscribing {
+		if t == b {
+			c.subscribing = append(c.subscribing[:i:i], c.subscribing[i+1:]...)
+			break
+		}
+	}
+	b.err = err
+	c.lock.Unlock()
+
+	close(b.subscribed)
+}
+
+// Locked version of topicBindingFor
+func (c *session) topicBindingFor(endpoint string) (uint, *topicBinding, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return topicBindingFor(c.events, endpoint, nil)
+}
+
+// The handlers events on the given node subscription go to
+func (c *session) eventHandlers(id uint) ([]*Subscription, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b, ok := c.events[id]
+	if !ok {
+		return nil, false
+	}
+	return append([]*Subscription(nil), b.handlers...), true
+}
+
+// Hang a binding's handlers off the node subscription with the given id. The
+// node hands back the id it already gave us when we subscribe to the same
+// topic twice, in which case the handlers join those already there.
+func (c *session) bindTopic(id uint, b *topicBinding) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	existing, ok := c.events[id]
+	if !ok {
+		c.events[id] = b
+		return
+	}
+
+	for _, s := range b.handlers {
+		s.topic = existing
+	}
+	existing.handlers = append(existing.handlers, b.handlers...)
+}
+
+// Empty out the event bindings, returning what they held
+func (c *session) takeTopics() map[uint]*topicBinding {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	taken := make(map[uint]*topicBinding, len(c.events))
+	for id, b := range c.events {
+		taken[id] = b
+		delete(c.events, id)
+	}
+	return taken
+}